@@ -0,0 +1,94 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"sync"
+	"time"
+
+	"kubernetes-integration/internal/autoscale"
+
+	"github.com/gin-gonic/gin"
+	"golang.org/x/sync/singleflight"
+)
+
+// backpressureTTL is how long the queue depths are reused across enqueues
+const backpressureTTL = time.Second
+
+// backpressure rejects the enqueues on queues holding MAX_QUEUE_DEPTH workflows or more, enqueued or
+// running, so that a backlog the workers cannot keep up with stops growing. The depths are those of
+// the queue metrics, reused for backpressureTTL: a burst of enqueues may overshoot the limit.
+type backpressure struct {
+	metrics func(ctx context.Context) (map[string]autoscale.QueueMetric, error)
+	live    *liveConfig
+	// The enqueues finding the depths expired share a single computation
+	refresh singleflight.Group
+
+	mu         sync.Mutex
+	depths     map[string]int
+	computedAt time.Time
+}
+
+// newBackpressure returns a backpressure reading the queue depths from metrics and the limit from live
+func newBackpressure(metrics func(ctx context.Context) (map[string]autoscale.QueueMetric, error), live *liveConfig) *backpressure {
+	return &backpressure{metrics: metrics, live: live}
+}
+
+// admit answers 429 and returns false when the queue is full. Enqueues are admitted when the depths
+// cannot be computed within ENQUEUE_TIMEOUT: failing them would make the admin server a dependency of
+// every enqueue.
+func (b *backpressure) admit(c *gin.Context, queueName string) bool {
+	settings := b.live.load()
+	maxDepth := settings.MaxQueueDepth
+	if maxDepth == 0 {
+		return true
+	}
+	ctx, cancel := enqueueContext(c, settings.EnqueueTimeout)
+	defer cancel()
+	depth, err := b.depth(ctx, queueName)
+	if err != nil {
+		slog.Warn("Computing the queue depth failed, admitting the enqueue", "queue", queueName, "error", err)
+		return true
+	}
+	if depth < maxDepth {
+		return true
+	}
+	c.Header("Retry-After", "1")
+	respondErrorWithDetails(c, http.StatusTooManyRequests, ErrCodeQueueFull,
+		fmt.Sprintf("Queue %s holds %d workflows, the limit is %d: retry later", queueName, depth, maxDepth),
+		gin.H{"queue": queueName, "depth": depth, "limit": maxDepth})
+	return false
+}
+
+// depth returns the enqueued and running workflows of the queue, recomputing the depths once expired.
+// The computation runs outside of the lock, which only guards swapping the depths.
+func (b *backpressure) depth(ctx context.Context, queueName string) (int, error) {
+	b.mu.Lock()
+	depths := b.depths
+	expired := depths == nil || time.Since(b.computedAt) > backpressureTTL
+	b.mu.Unlock()
+
+	if expired {
+		computed, err, _ := b.refresh.Do("depths", func() (any, error) {
+			metrics, err := b.metrics(ctx)
+			if err != nil {
+				return nil, err
+			}
+			depths := make(map[string]int, len(metrics))
+			for name, metric := range metrics {
+				depths[name] = metric.QueueLength
+			}
+			b.mu.Lock()
+			b.depths, b.computedAt = depths, time.Now()
+			b.mu.Unlock()
+			return depths, nil
+		})
+		if err != nil {
+			return 0, err
+		}
+		depths = computed.(map[string]int)
+	}
+	return depths[queueName], nil
+}
@@ -0,0 +1,183 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"strings"
+
+	"github.com/dbos-inc/dbos-transact-golang/dbos"
+)
+
+// commandUsage lists the subcommands, printed with the flags of the one that failed to parse
+const commandUsage = `Usage: main [command] [flags]
+
+Commands:
+  serve     serve the HTTP API and run the enqueued workflows (default)
+  enqueue   enqueue a sleep workflow and print its ID
+  status    print the status of a workflow
+  metrics   print the queue metrics and expected pods
+
+`
+
+// commandFromArgs splits the command line into the subcommand and its arguments, defaulting to serve
+// so that flags such as --selftest keep working without a subcommand
+func commandFromArgs(args []string) (string, []string) {
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		return args[0], args[1:]
+	}
+	return "serve", args
+}
+
+// runCommand parses the flags of the subcommand, loads the configuration and runs the subcommand,
+// returning the process exit code
+func runCommand(command string, args []string) int {
+	flags := flag.NewFlagSet(command, flag.ContinueOnError)
+	flags.Usage = func() {
+		fmt.Fprint(flags.Output(), commandUsage)
+		fmt.Fprintf(flags.Output(), "Flags of %s:\n", command)
+		flags.PrintDefaults()
+	}
+
+	var run func(config AppConfig) int
+	switch command {
+	case "serve":
+		selfTest := flags.Bool("selftest", false, "enqueue a short workflow, wait for its result and exit 0 on success, without serving HTTP")
+		run = func(config AppConfig) int { return runServer(config, *selfTest) }
+	case "enqueue":
+		duration := flags.Int("duration", 0, "seconds the workflow sleeps")
+		queueName := flags.String("queue", "", "queue to enqueue on, the first configured queue if empty")
+		run = func(config AppConfig) int { return enqueueCommand(config, *duration, *queueName) }
+	case "status":
+		workflowID := flags.String("id", "", "ID of the workflow (required)")
+		run = func(config AppConfig) int { return statusCommand(config, *workflowID) }
+	case "metrics":
+		run = metricsCommand
+	default:
+		fmt.Fprintf(os.Stderr, "Unknown command %q\n\n%s", command, commandUsage)
+		return 2
+	}
+	if err := flags.Parse(args); err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			return 0
+		}
+		return 2
+	}
+
+	// The other subcommands print their result on stdout, so they log to stderr
+	var logOutput io.Writer = os.Stderr
+	if command == "serve" {
+		logOutput = os.Stdout
+	}
+	slog.SetDefault(slog.New(slog.NewJSONHandler(logOutput, nil)))
+
+	config, err := loadConfig()
+	if err != nil {
+		slog.Error("Loading configuration failed", "error", err)
+		return 1
+	}
+	slog.Info("Loaded configuration", "config", config)
+	return run(config)
+}
+
+// printJSON prints value as indented JSON on stdout
+func printJSON(value any) int {
+	encoder := json.NewEncoder(os.Stdout)
+	encoder.SetIndent("", "  ")
+	if err := encoder.Encode(value); err != nil {
+		slog.Error("Printing the result failed", "error", err)
+		return 1
+	}
+	return 0
+}
+
+// enqueueCommand enqueues a sleep workflow, for a serving pod to run, and prints its ID
+func enqueueCommand(config AppConfig, duration int, queueName string) int {
+	input := SleepWorkflowInput{DurationSeconds: duration}
+	if err := input.validate(config.MaxSleepSeconds); err != nil {
+		slog.Error("Invalid workflow input", "error", err)
+		return 2
+	}
+	dbosContext, queues, err := setupDBOS(config, false)
+	if err != nil {
+		slog.Error("Starting DBOS failed", "error", err)
+		return 1
+	}
+	defer dbos.Shutdown(dbosContext, config.ShutdownTimeout)
+
+	queue := queues[0]
+	if queueName != "" {
+		found := false
+		for _, candidate := range queues {
+			if candidate.Name == queueName {
+				queue, found = candidate, true
+			}
+		}
+		if !found {
+			slog.Error("Unknown queue", "queue", queueName)
+			return 2
+		}
+	}
+	handle, err := dbos.RunWorkflow(dbosContext, SleepWorkflow, input, dbos.WithQueue(queue.Name))
+	if err != nil {
+		slog.Error("Enqueuing the workflow failed", "error", err)
+		return 1
+	}
+	return printJSON(map[string]any{"workflow_id": handle.GetWorkflowID(), "queue": queue.Name, "duration": duration})
+}
+
+// statusCommand prints the status of a workflow, as returned by GET /workflow/:id
+func statusCommand(config AppConfig, workflowID string) int {
+	if workflowID == "" {
+		slog.Error("The status command requires --id")
+		return 2
+	}
+	dbosContext, _, err := setupDBOS(config, false)
+	if err != nil {
+		slog.Error("Starting DBOS failed", "error", err)
+		return 1
+	}
+	defer dbos.Shutdown(dbosContext, config.ShutdownTimeout)
+
+	// An unlaunched context does not load the outputs unless asked to
+	workflows, err := dbos.ListWorkflows(dbosContext, dbos.WithWorkflowIDs([]string{workflowID}), dbos.WithLoadInput(false), dbos.WithLoadOutput(true))
+	if err != nil {
+		slog.Error("Retrieving the workflow failed", "error", err)
+		return 1
+	}
+	if len(workflows) == 0 {
+		slog.Error("Workflow not found", "workflow_id", workflowID)
+		return 1
+	}
+	return printJSON(newWorkflowStatusResponse(workflows[0]))
+}
+
+// metricsCommand prints the queue metrics and expected pods, as returned by /metrics. It reads the
+// queue metadata from the admin server of a serving pod, or from MOCK_ADMIN_FILE.
+func metricsCommand(config AppConfig) int {
+	dbosContext, _, err := setupDBOS(config, false)
+	if err != nil {
+		slog.Error("Starting DBOS failed", "error", err)
+		return 1
+	}
+	defer dbos.Shutdown(dbosContext, config.ShutdownTimeout)
+
+	metadataSource, err := newMetadataSource(config)
+	if err != nil {
+		slog.Error("Creating the queue metadata source failed", "error", err)
+		return 1
+	}
+	autoscaler := newAutoscaler(config, metadataSource, dbosContext)
+	metrics, err := autoscaler.QueueMetrics(context.Background(), true)
+	if err != nil {
+		slog.Error("Computing the metrics failed", "error", err)
+		return 1
+	}
+	expectedPods, capped := autoscaler.ExpectedPods(metrics)
+	return printJSON(QueueMetricsResponse{ExpectedPods: expectedPods, Capped: capped, Queues: metrics})
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"sync"
+
+	"kubernetes-integration/internal/autoscale"
+
+	"github.com/gin-gonic/gin"
+)
+
+// concurrencyOverrides is a metadata source replacing the worker concurrency of some queues, so that
+// experiments can show how the pod computation responds without redeploying. DBOS cannot change the
+// concurrency of a registered queue, so the pods keep dequeuing at the registered one. The overrides
+// are held in memory: they apply to this pod only and do not survive a restart.
+type concurrencyOverrides struct {
+	source autoscale.MetadataSource
+
+	mu        sync.Mutex
+	overrides map[string]int
+}
+
+// newConcurrencyOverrides returns a metadata source reading from source, without overrides
+func newConcurrencyOverrides(source autoscale.MetadataSource) *concurrencyOverrides {
+	return &concurrencyOverrides{source: source, overrides: make(map[string]int)}
+}
+
+// QueueMetadata returns the metadata of the source with the overridden worker concurrencies
+func (o *concurrencyOverrides) QueueMetadata(ctx context.Context, forceRefresh bool) ([]autoscale.QueueMetadata, error) {
+	metadata, err := o.source.QueueMetadata(ctx, forceRefresh)
+	if err != nil {
+		return nil, err
+	}
+
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if len(o.overrides) == 0 {
+		return metadata, nil
+	}
+	// The source may cache its slice, so the overrides apply to a copy
+	overridden := make([]autoscale.QueueMetadata, len(metadata))
+	for i, queue := range metadata {
+		if value, ok := o.overrides[queue.Name]; ok {
+			queue.WorkerConcurrency = value
+		}
+		overridden[i] = queue
+	}
+	return overridden, nil
+}
+
+// set overrides the worker concurrency of the queue
+func (o *concurrencyOverrides) set(queueName string, value int) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.overrides[queueName] = value
+	slog.Warn("Overriding the worker concurrency of the pod computation", "queue", queueName, "worker_concurrency", value)
+}
+
+// reset removes the override of the queue, returning whether it had one
+func (o *concurrencyOverrides) reset(queueName string) bool {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	_, ok := o.overrides[queueName]
+	delete(o.overrides, queueName)
+	if ok {
+		slog.Info("Removed the worker concurrency override", "queue", queueName)
+	}
+	return ok
+}
+
+// registeredQueue returns the metadata of the named queue as registered with DBOS. It responds with 404
+// and returns false when the queue is unknown, or with the metrics error when the metadata is unavailable.
+func registeredQueue(c *gin.Context, source autoscale.MetadataSource, queueName string) (autoscale.QueueMetadata, bool) {
+	metadata, err := source.QueueMetadata(c.Request.Context(), false)
+	if err != nil {
+		respondMetricsError(c, fmt.Errorf("%w: %w", autoscale.ErrMetadataUnavailable, err))
+		return autoscale.QueueMetadata{}, false
+	}
+	for _, queue := range metadata {
+		if queue.Name == queueName {
+			return queue, true
+		}
+	}
+	respondError(c, http.StatusNotFound, ErrCodeQueueNotFound, fmt.Sprintf("Unknown queue: %s", queueName))
+	return autoscale.QueueMetadata{}, false
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// drainPollInterval is the interval between two counts of the remaining workflows while draining
+const drainPollInterval = 2 * time.Second
+
+// DrainStatus reports the progress of a drain, as returned by /drain and /drain/status
+type DrainStatus struct {
+	Draining  bool       `json:"draining"`
+	Drained   bool       `json:"drained"`   // Whether the queues were found empty since the drain started
+	Remaining int        `json:"remaining"` // Enqueued and running workflows at the last count
+	StartedAt *time.Time `json:"started_at,omitempty"`
+	DrainedAt *time.Time `json:"drained_at,omitempty"`
+	Error     string     `json:"error,omitempty"` // Why the last count failed, if it did
+}
+
+// drainer stops the enqueue endpoints and tracks the queues until they are empty.
+// A drain cannot be undone: it prepares the pod for shutdown.
+type drainer struct {
+	background     context.Context // Stops tracking the queues when done
+	countRemaining func(ctx context.Context) (int, error)
+	pollInterval   time.Duration
+
+	mu     sync.Mutex
+	status DrainStatus
+}
+
+// newDrainer returns a drainer counting the remaining workflows with countRemaining until background is done
+func newDrainer(background context.Context, countRemaining func(ctx context.Context) (int, error)) *drainer {
+	return &drainer{background: background, countRemaining: countRemaining, pollInterval: drainPollInterval}
+}
+
+// start begins draining, if not already, and returns the drain status after a first count
+func (d *drainer) start(ctx context.Context) DrainStatus {
+	d.mu.Lock()
+	started := d.status.Draining
+	if !started {
+		now := time.Now()
+		d.status = DrainStatus{Draining: true, StartedAt: &now}
+		slog.Info("Draining: the enqueue endpoints now reject new workflows")
+	}
+	d.mu.Unlock()
+
+	if !started && !d.poll(ctx) {
+		go d.wait()
+	}
+	return d.snapshot()
+}
+
+// wait polls the remaining workflows until the queues are empty or the server shuts down
+func (d *drainer) wait() {
+	ticker := time.NewTicker(d.pollInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-d.background.Done():
+			return
+		case <-ticker.C:
+			if d.poll(d.background) {
+				return
+			}
+		}
+	}
+}
+
+// poll counts the remaining workflows, returning whether the queues are drained
+func (d *drainer) poll(ctx context.Context) bool {
+	remaining, err := d.countRemaining(ctx)
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if err != nil {
+		slog.Warn("Counting the workflows left to drain failed", "error", err)
+		d.status.Error = err.Error()
+		return false
+	}
+	d.status.Error = ""
+	d.status.Remaining = remaining
+	if remaining == 0 {
+		now := time.Now()
+		d.status.Drained = true
+		d.status.DrainedAt = &now
+		slog.Info("Drained: no workflow left on the queues")
+	}
+	return d.status.Drained
+}
+
+// snapshot returns the current drain status
+func (d *drainer) snapshot() DrainStatus {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.status
+}
+
+// rejectWhileDraining answers 503 once a drain has started
+func rejectWhileDraining(d *drainer) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if d.snapshot().Draining {
+			respondError(c, http.StatusServiceUnavailable, ErrCodeDraining, "Draining: not accepting new workflows")
+		}
+	}
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// enqueueLatencyWindow is the number of recent enqueues averaged in /info
+const enqueueLatencyWindow = 100
+
+// enqueueLatencyTracker records how long the RunWorkflow calls enqueuing workflows take, both in a
+// histogram for /prometheus and as a moving average of the most recent enqueues for /info. It also
+// counts the calls and their failures by queue for /prometheus.
+type enqueueLatencyTracker struct {
+	histogram prometheus.Histogram
+	attempts  *prometheus.CounterVec
+	failures  *prometheus.CounterVec
+
+	mu      sync.Mutex
+	samples [enqueueLatencyWindow]time.Duration
+	next    int // Index the next sample is written to
+	count   int // Number of samples held, up to the window
+	sum     time.Duration
+}
+
+// enqueueLatency is shared by every enqueue endpoint
+var enqueueLatency = &enqueueLatencyTracker{
+	histogram: prometheus.NewHistogram(prometheus.HistogramOpts{
+		Name:    "dbos_enqueue_duration_seconds",
+		Help:    "Time spent enqueuing a workflow with RunWorkflow, including failed attempts.",
+		Buckets: []float64{.001, .0025, .005, .01, .025, .05, .1, .25, .5, 1, 2.5},
+	}),
+	attempts: prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "dbos_enqueue_total",
+		Help: "Number of workflows the enqueue endpoints tried to enqueue on the queue, including failed attempts.",
+	}, []string{"queue"}),
+	failures: prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "dbos_enqueue_errors_total",
+		Help: "Number of workflows the enqueue endpoints failed to enqueue on the queue.",
+	}, []string{"queue"}),
+}
+
+// collectors returns the Prometheus collectors of the enqueues
+func (t *enqueueLatencyTracker) collectors() []prometheus.Collector {
+	return []prometheus.Collector{t.histogram, t.attempts, t.failures}
+}
+
+// observe records an enqueue on the queue that started at start and failed with err, if not nil
+func (t *enqueueLatencyTracker) observe(start time.Time, queueName string, err error) {
+	duration := time.Since(start)
+	t.histogram.Observe(duration.Seconds())
+	t.attempts.WithLabelValues(queueName).Inc()
+	if err != nil {
+		t.failures.WithLabelValues(queueName).Inc()
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.sum += duration - t.samples[t.next]
+	t.samples[t.next] = duration
+	t.next = (t.next + 1) % len(t.samples)
+	t.count = min(t.count+1, len(t.samples))
+}
+
+// average returns the mean duration of the most recent enqueues, 0 before the first one
+func (t *enqueueLatencyTracker) average() time.Duration {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.count == 0 {
+		return 0
+	}
+	return t.sum / time.Duration(t.count)
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+
+	"kubernetes-integration/internal/autoscale"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Machine-readable codes of the API errors
+const (
+	ErrCodeInvalidDuration     = "INVALID_DURATION"
+	ErrCodeInvalidParameter    = "INVALID_PARAMETER"
+	ErrCodeInvalidBody         = "INVALID_BODY"
+	ErrCodeQueueNotFound       = "QUEUE_NOT_FOUND"
+	ErrCodeWorkflowNotFound    = "WORKFLOW_NOT_FOUND"
+	ErrCodeWorkflowCompleted   = "WORKFLOW_COMPLETED"
+	ErrCodeWorkflowActive      = "WORKFLOW_ACTIVE"
+	ErrCodeWorkflowTimeout     = "WORKFLOW_TIMEOUT"
+	ErrCodeIdempotencyConflict = "IDEMPOTENCY_CONFLICT"
+	ErrCodeDuplicateWorkflow   = "DUPLICATE_WORKFLOW"
+	ErrCodeEnqueueFailed       = "ENQUEUE_FAILED"
+	ErrCodeEnqueueTimeout      = "ENQUEUE_TIMEOUT"
+	ErrCodeAdminUnreachable    = "ADMIN_UNREACHABLE"
+	ErrCodeDatabaseError       = "DATABASE_ERROR"
+	ErrCodeNotReady            = "NOT_READY"
+	ErrCodeUnauthorized        = "UNAUTHORIZED"
+	ErrCodeStalled             = "STALLED"
+	ErrCodeRateLimited         = "RATE_LIMITED"
+	ErrCodeQueueFull           = "QUEUE_FULL"
+	ErrCodeDraining            = "DRAINING"
+	ErrCodeOverloaded          = "OVERLOADED"
+	ErrCodePayloadTooLarge     = "PAYLOAD_TOO_LARGE"
+	ErrCodeInternal            = "INTERNAL"
+)
+
+// APIError is the body of every error response
+type APIError struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+	Details any    `json:"details,omitempty"`
+}
+
+// respondError aborts the request with an APIError body
+func respondError(c *gin.Context, status int, code, message string) {
+	respondErrorWithDetails(c, status, code, message, nil)
+}
+
+// respondErrorWithDetails aborts the request with an APIError body carrying details
+func respondErrorWithDetails(c *gin.Context, status int, code, message string, details any) {
+	c.AbortWithStatusJSON(status, APIError{Code: code, Message: message, Details: details})
+}
+
+// respondMetricsError responds to a failed metrics computation, telling apart admin server and database failures
+func respondMetricsError(c *gin.Context, err error) {
+	code := ErrCodeDatabaseError
+	if errors.Is(err, autoscale.ErrMetadataUnavailable) {
+		code = ErrCodeAdminUnreachable
+	}
+	respondError(c, http.StatusInternalServerError, code, fmt.Sprintf("Error computing metrics: %v", err))
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"sync"
+	"time"
+
+	"kubernetes-integration/internal/autoscale"
+
+	"github.com/dbos-inc/dbos-transact-golang/dbos"
+	"golang.org/x/sync/singleflight"
+)
+
+const (
+	// estimateTTL is how long the inputs of a queue's start estimate are reused across enqueues
+	estimateTTL = 5 * time.Second
+	// estimateSampleSize is the number of recently completed workflows averaged when no duration is configured
+	estimateSampleSize = 20
+)
+
+// startEstimator estimates, on a best-effort basis, how long a workflow enqueued now waits before
+// starting: the workflows ahead of it, divided by the workflows the queue runs at once, times the
+// average workflow duration. Priorities, running workflows and pods still starting are ignored.
+type startEstimator struct {
+	dbosContext dbos.DBOSContext
+	metrics     func(ctx context.Context) (map[string]autoscale.QueueMetric, error)
+	// The enqueues finding the inputs of a queue expired share a single computation
+	refresh singleflight.Group
+
+	mu              sync.Mutex
+	averageDuration time.Duration // Configured average duration, 0 to measure it from completed workflows
+	queues          map[string]queueEstimate
+}
+
+// queueEstimate holds the inputs of a queue's start estimate
+type queueEstimate struct {
+	computedAt      time.Time
+	ahead           int           // Enqueued workflows
+	slots           int           // Workflows run at once, 0 when unlimited
+	averageDuration time.Duration // 0 when unknown
+}
+
+// newStartEstimator returns an estimator reading the queue backlogs from metrics
+func newStartEstimator(dbosContext dbos.DBOSContext, metrics func(ctx context.Context) (map[string]autoscale.QueueMetric, error), averageDuration time.Duration) *startEstimator {
+	return &startEstimator{
+		dbosContext:     dbosContext,
+		metrics:         metrics,
+		averageDuration: averageDuration,
+		queues:          make(map[string]queueEstimate),
+	}
+}
+
+// setAverageDuration replaces the configured average duration, dropping the cached estimate inputs
+func (e *startEstimator) setAverageDuration(averageDuration time.Duration) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.averageDuration = averageDuration
+	clear(e.queues)
+}
+
+// estimate returns the estimated seconds before a workflow enqueued now on the queue starts, or nil
+// when there is not enough data to estimate it or its inputs cannot be computed before ctx is done.
+// The inputs are computed outside of the lock, which only guards reading and storing them.
+func (e *startEstimator) estimate(ctx context.Context, queueName string) *float64 {
+	e.mu.Lock()
+	inputs, ok := e.queues[queueName]
+	averageDuration := e.averageDuration
+	e.mu.Unlock()
+
+	if !ok || time.Since(inputs.computedAt) > estimateTTL {
+		computed := e.refresh.DoChan(queueName, func() (any, error) {
+			inputs, err := e.compute(ctx, queueName, averageDuration)
+			if err != nil {
+				return nil, err
+			}
+			e.mu.Lock()
+			// Inputs computed with an average duration replaced since are dropped, like the cached ones
+			if e.averageDuration == averageDuration {
+				e.queues[queueName] = inputs
+			}
+			e.mu.Unlock()
+			return inputs, nil
+		})
+		select {
+		case result := <-computed:
+			if result.Err != nil {
+				slog.Debug("Estimating the workflow start failed", "queue", queueName, "error", result.Err)
+				return nil
+			}
+			inputs = result.Val.(queueEstimate)
+		case <-ctx.Done():
+			slog.Debug("Estimating the workflow start failed", "queue", queueName, "error", ctx.Err())
+			return nil
+		}
+	}
+
+	var seconds float64
+	switch {
+	case inputs.ahead == 0 || inputs.slots == 0:
+	case inputs.averageDuration == 0:
+		return nil
+	default:
+		seconds = float64(inputs.ahead) / float64(inputs.slots) * inputs.averageDuration.Seconds()
+	}
+	return &seconds
+}
+
+// compute computes the inputs of the queue's start estimate, measuring the average duration from the
+// completed workflows when the configured one is 0
+func (e *startEstimator) compute(ctx context.Context, queueName string, averageDuration time.Duration) (queueEstimate, error) {
+	metrics, err := e.metrics(ctx)
+	if err != nil {
+		return queueEstimate{}, err
+	}
+	metric, ok := metrics[queueName]
+	if !ok {
+		return queueEstimate{}, fmt.Errorf("no metrics for queue %s", queueName)
+	}
+	inputs := queueEstimate{computedAt: time.Now(), ahead: metric.EnqueuedCount, slots: metric.GlobalConcurrency}
+	if metric.WorkerConcurrency > 0 {
+		// The pods requested for the queue approximate those running it
+		inputs.slots = metric.WorkerConcurrency * max(metric.ExpectedPods, 1)
+		if metric.GlobalConcurrency > 0 {
+			inputs.slots = min(inputs.slots, metric.GlobalConcurrency)
+		}
+	}
+
+	inputs.averageDuration = averageDuration
+	if inputs.averageDuration == 0 {
+		// ListWorkflows only stops once the DBOS context is done: give it the deadline of ctx
+		listCtx := e.dbosContext
+		if deadline, ok := ctx.Deadline(); ok {
+			var cancel context.CancelFunc
+			listCtx, cancel = withWorkflowTimeout(e.dbosContext, time.Until(deadline))
+			defer cancel()
+		}
+		completed, err := dbos.ListWorkflows(listCtx,
+			dbos.WithQueueName(queueName),
+			dbos.WithStatus([]dbos.WorkflowStatusType{dbos.WorkflowStatusSuccess}),
+			dbos.WithSortDesc(),
+			dbos.WithLimit(estimateSampleSize),
+			dbos.WithLoadInput(false),
+			dbos.WithLoadOutput(false),
+		)
+		if err != nil {
+			return queueEstimate{}, err
+		}
+		var total time.Duration
+		var n int
+		for _, workflow := range completed {
+			if workflow.StartedAt.IsZero() || workflow.UpdatedAt.Before(workflow.StartedAt) {
+				continue
+			}
+			total += workflow.UpdatedAt.Sub(workflow.StartedAt)
+			n++
+		}
+		if n > 0 {
+			inputs.averageDuration = total / time.Duration(n)
+		}
+	}
+	return inputs, nil
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"sync"
+	"time"
+
+	"kubernetes-integration/internal/autoscale"
+)
+
+// MetricsSample is a timestamped pod estimate recorded by /metrics
+type MetricsSample struct {
+	Timestamp    time.Time      `json:"timestamp"`
+	ExpectedPods int            `json:"expected_pods"`
+	QueueLengths map[string]int `json:"queue_lengths"`
+}
+
+// metricsHistory keeps the most recent samples in a fixed-size ring buffer
+type metricsHistory struct {
+	mu      sync.Mutex
+	samples []MetricsSample
+	next    int // Index the next sample is written to
+	full    bool
+}
+
+// newMetricsHistory returns a history holding up to size samples
+func newMetricsHistory(size int) *metricsHistory {
+	return &metricsHistory{samples: make([]MetricsSample, size)}
+}
+
+// record appends a sample, overwriting the oldest one once the buffer is full
+func (h *metricsHistory) record(expectedPods int, metrics map[string]autoscale.QueueMetric) {
+	queueLengths := make(map[string]int, len(metrics))
+	for name, metric := range metrics {
+		queueLengths[name] = metric.QueueLength
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.samples[h.next] = MetricsSample{Timestamp: time.Now(), ExpectedPods: expectedPods, QueueLengths: queueLengths}
+	h.next = (h.next + 1) % len(h.samples)
+	if h.next == 0 {
+		h.full = true
+	}
+}
+
+// snapshot returns the recorded samples, oldest first
+func (h *metricsHistory) snapshot() []MetricsSample {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if !h.full {
+		return append([]MetricsSample(nil), h.samples[:h.next]...)
+	}
+	return append(append([]MetricsSample(nil), h.samples[h.next:]...), h.samples[:h.next]...)
+}
+
+// lastKnownMetrics keeps the most recent queue metrics computed successfully, to serve while they cannot be computed
+type lastKnownMetrics struct {
+	mu         sync.Mutex
+	metrics    map[string]autoscale.QueueMetric
+	computedAt time.Time
+}
+
+// store records successfully computed metrics
+func (l *lastKnownMetrics) store(metrics map[string]autoscale.QueueMetric) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.metrics = metrics
+	l.computedAt = time.Now()
+}
+
+// load returns the last known metrics if they are at most maxAge old, and their age
+func (l *lastKnownMetrics) load(maxAge time.Duration) (map[string]autoscale.QueueMetric, time.Duration, bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	age := time.Since(l.computedAt)
+	if l.metrics == nil || age > maxAge {
+		return nil, age, false
+	}
+	return l.metrics, age, true
+}
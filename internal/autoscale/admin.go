@@ -0,0 +1,195 @@
+package autoscale
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"slices"
+	"sync"
+	"time"
+
+	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
+)
+
+// AdminConfig holds the settings of an AdminMetadataSource
+type AdminConfig struct {
+	URL            string        // URL of the admin server's /dbos-workflow-queues-metadata endpoint
+	Timeout        time.Duration // Timeout of a single request to the admin server
+	RetryAttempts  int           // Attempts before a fetch fails
+	RetryBaseDelay time.Duration // Delay before the first retry, doubled on each retry
+	CacheTTL       time.Duration // How long fetched metadata is served from cache
+}
+
+// AdminMetadataSource reads the queue metadata from the DBOS admin server and caches it,
+// since it rarely changes, across scrapes
+type AdminMetadataSource struct {
+	config    AdminConfig
+	client    *http.Client
+	mu        sync.Mutex
+	metadata  []QueueMetadata
+	fetchedAt time.Time
+}
+
+// NewAdminMetadataSource returns a MetadataSource backed by the DBOS admin server
+func NewAdminMetadataSource(config AdminConfig) *AdminMetadataSource {
+	return &AdminMetadataSource{
+		config: config,
+		// The transport records a client span per request to the admin server
+		client: &http.Client{Timeout: config.Timeout, Transport: otelhttp.NewTransport(http.DefaultTransport)},
+	}
+}
+
+// QueueMetadata returns the cached queue metadata, refreshing it when older than the TTL or when forceRefresh is set.
+// If the refresh fails, the last fetched metadata is returned instead, if any.
+func (s *AdminMetadataSource) QueueMetadata(ctx context.Context, forceRefresh bool) ([]QueueMetadata, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if !forceRefresh && s.metadata != nil && time.Since(s.fetchedAt) < s.config.CacheTTL {
+		return s.metadata, nil
+	}
+
+	metadata, err := s.fetchWithRetry(ctx)
+	if err != nil {
+		if s.metadata != nil {
+			slog.Warn("Serving stale queue metadata", "error", err)
+			return s.metadata, nil
+		}
+		return nil, err
+	}
+	s.metadata = metadata
+	s.fetchedAt = time.Now()
+	return metadata, nil
+}
+
+// fetchWithRetry fetches the queue metadata, retrying failed attempts with exponential backoff
+func (s *AdminMetadataSource) fetchWithRetry(ctx context.Context) ([]QueueMetadata, error) {
+	delay := s.config.RetryBaseDelay
+	for attempt := 1; ; attempt++ {
+		metadata, err := s.fetch(ctx)
+		if err == nil || attempt >= s.config.RetryAttempts {
+			return metadata, err
+		}
+		slog.Debug("Retrying queue metadata fetch", "attempt", attempt, "delay", delay, "error", err)
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+		delay *= 2
+	}
+}
+
+// fetch retrieves the queues and their worker concurrency from the admin server
+func (s *AdminMetadataSource) fetch(ctx context.Context) ([]QueueMetadata, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, s.config.URL, nil)
+	if err != nil {
+		return nil, fmt.Errorf("fetching queue metadata: %w", err)
+	}
+	resp, err := s.client.Do(req)
+	if err != nil {
+		var urlErr *url.Error
+		if errors.As(err, &urlErr) && urlErr.Timeout() {
+			return nil, fmt.Errorf("fetching queue metadata: admin server did not answer within %s", s.client.Timeout)
+		}
+		return nil, fmt.Errorf("fetching queue metadata: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("fetching queue metadata: unexpected status %s", resp.Status)
+	}
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("reading queue metadata: %w", err)
+	}
+	return decodeQueueMetadata(data)
+}
+
+// decodeQueueMetadata decodes the queue metadata returned by the admin server, tolerating the shape changes
+// of other DBOS versions with a warning: an array wrapped in an object, entries without a name, which are
+// skipped, and fields of an unexpected type, which are left to their zero value. Missing fields are zero.
+func decodeQueueMetadata(data []byte) ([]QueueMetadata, error) {
+	var queuesMetadata []QueueMetadata
+	if err := json.Unmarshal(data, &queuesMetadata); err == nil {
+		named := queuesMetadata[:0]
+		for i, queue := range queuesMetadata {
+			if queue.Name == "" {
+				slog.Warn("Skipping queue metadata entry without a name", "index", i)
+				continue
+			}
+			named = append(named, queue)
+		}
+		return named, nil
+	}
+
+	var entries []json.RawMessage
+	if err := json.Unmarshal(data, &entries); err != nil {
+		var wrapper map[string]json.RawMessage
+		if json.Unmarshal(data, &wrapper) != nil {
+			return nil, fmt.Errorf("decoding queue metadata: %w", err)
+		}
+		// Read the first array of the object, in key order so that the choice is stable
+		keys := make([]string, 0, len(wrapper))
+		for key := range wrapper {
+			keys = append(keys, key)
+		}
+		slices.Sort(keys)
+		index := slices.IndexFunc(keys, func(key string) bool { return json.Unmarshal(wrapper[key], &entries) == nil })
+		if index < 0 {
+			return nil, errors.New("decoding queue metadata: neither an array nor an object holding one")
+		}
+		slog.Warn("Queue metadata is an object, reading the queues from one of its fields", "field", keys[index])
+	}
+
+	queuesMetadata = make([]QueueMetadata, 0, len(entries))
+	for i, entry := range entries {
+		var object map[string]json.RawMessage
+		if err := json.Unmarshal(entry, &object); err != nil {
+			slog.Warn("Skipping queue metadata entry that is not an object", "index", i)
+			continue
+		}
+		var queue QueueMetadata
+		var mismatched []string
+		for _, field := range []struct {
+			key    string
+			decode func(json.RawMessage) error
+		}{
+			{"name", decodeInto(&queue.Name)},
+			{"workerConcurrency", decodeInto(&queue.WorkerConcurrency)},
+			{"concurrency", decodeInto(&queue.GlobalConcurrency)},
+			{"priorityEnabled", decodeInto(&queue.PriorityEnabled)},
+			{"enqueuedCount", decodeInto(&queue.EnqueuedCount)},
+			{"runningCount", decodeInto(&queue.RunningCount)},
+		} {
+			if raw, ok := object[field.key]; ok && field.decode(raw) != nil {
+				mismatched = append(mismatched, field.key)
+			}
+		}
+		if queue.Name == "" {
+			slog.Warn("Skipping queue metadata entry without a name", "index", i)
+			continue
+		}
+		if mismatched != nil {
+			slog.Warn("Ignoring queue metadata fields of an unexpected type", "queue", queue.Name, "fields", mismatched)
+		}
+		queuesMetadata = append(queuesMetadata, queue)
+	}
+	return queuesMetadata, nil
+}
+
+// decodeInto returns a function decoding JSON into target, which it leaves unchanged when decoding fails
+func decodeInto[T any](target *T) func(json.RawMessage) error {
+	return func(raw json.RawMessage) error {
+		var value T
+		if err := json.Unmarshal(raw, &value); err != nil {
+			return err
+		}
+		*target = value
+		return nil
+	}
+}
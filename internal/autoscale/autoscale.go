@@ -0,0 +1,471 @@
+// Package autoscale computes how many pods are needed to process the workflows enqueued on DBOS queues.
+//
+// The queue metadata and the queued workflows are obtained through the MetadataSource and
+// WorkflowLister interfaces, so that the computation can be exercised without DBOS.
+package autoscale
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/dbos-inc/dbos-transact-golang/dbos"
+	"golang.org/x/sync/errgroup"
+)
+
+// QueueMetadata describes a queue as reported by the DBOS admin server
+type QueueMetadata struct {
+	Name              string `json:"name"`
+	WorkerConcurrency int    `json:"workerConcurrency"`
+	GlobalConcurrency int    `json:"concurrency"` // 0 when the queue has no global limit
+	PriorityEnabled   bool   `json:"priorityEnabled"`
+
+	// Workflows waiting on and dequeued from the queue, for admin servers reporting them. The DBOS
+	// admin server does not, but a metadata source that does saves listing the workflows.
+	EnqueuedCount *int `json:"enqueuedCount,omitempty"`
+	RunningCount  *int `json:"runningCount,omitempty"`
+}
+
+// MetadataSource provides the queues registered with DBOS and their worker concurrency
+type MetadataSource interface {
+	// QueueMetadata returns the registered queues. forceRefresh bypasses any caching.
+	QueueMetadata(ctx context.Context, forceRefresh bool) ([]QueueMetadata, error)
+}
+
+// WorkflowLister provides the ENQUEUED and PENDING workflows of all queues, one page at a time
+type WorkflowLister interface {
+	// ListQueuedWorkflows returns at most limit workflows, skipping the first offset ones
+	ListQueuedWorkflows(ctx context.Context, offset, limit int) ([]dbos.WorkflowStatus, error)
+}
+
+// defaultPageSize is the number of workflows listed at a time when Config.PageSize is unset
+const defaultPageSize = 1000
+
+// ErrMetadataUnavailable is wrapped by the errors of QueueMetrics when the queue metadata could not be fetched
+var ErrMetadataUnavailable = errors.New("queue metadata unavailable")
+
+// QueueMetric holds the autoscaling inputs and result for a single queue
+type QueueMetric struct {
+	QueueLength       int  `json:"queue_length"`
+	EnqueuedCount     int  `json:"enqueued_count"` // Workflows waiting to be dequeued
+	RunningCount      int  `json:"running_count"`  // Workflows dequeued and running
+	WorkerConcurrency int  `json:"worker_concurrency"`
+	GlobalConcurrency int  `json:"global_concurrency,omitempty"`
+	ExpectedPods      int  `json:"expected_pods"`
+	Excluded          bool `json:"excluded,omitempty"` // Whether the queue is left out of the overall expected pods
+
+	// Worker slots: those running workflows, and those of the expected pods, capped by the global
+	// concurrency. TotalSlots is 0 without a worker concurrency. A queue with a backlog and every slot
+	// active needs more pods, while one with idle slots is waiting on pods to start or dequeue.
+	ActiveSlots int `json:"active_slots"`
+	TotalSlots  int `json:"total_slots"`
+
+	// Age of the oldest workflow waiting to be dequeued, 0 when none is or when the counts come from the metadata
+	OldestAgeSeconds float64 `json:"oldest_age_seconds"`
+
+	// Age of the counts when listing the workflows failed and the last listed counts stood in, 0 when fresh
+	CountsAgeSeconds float64 `json:"counts_age_seconds,omitempty"`
+
+	// Enqueued workflows by priority, lower values running first, for queues with priorities enabled
+	EnqueuedByPriority map[int]int `json:"enqueued_by_priority,omitempty"`
+}
+
+// ScaleMode selects how the backlog of a queue translates into pods: the Scaler registered for it
+type ScaleMode string
+
+const (
+	// ScaleModeBacklog requests enough pods to run the whole backlog at once
+	ScaleModeBacklog ScaleMode = "backlog"
+	// ScaleModeLatency requests enough pods to drain the backlog within Config.TargetDrainTime,
+	// given workflows lasting Config.AverageDuration
+	ScaleModeLatency ScaleMode = "latency"
+)
+
+// CountSource selects where the numbers of enqueued and running workflows come from
+type CountSource string
+
+const (
+	// CountSourceAuto uses the counts of the queue metadata when every queue has them, and lists the workflows otherwise
+	CountSourceAuto CountSource = "auto"
+	// CountSourceAdmin uses the counts of the queue metadata, failing when a queue has none
+	CountSourceAdmin CountSource = "admin"
+	// CountSourceList counts the workflows listed by the WorkflowLister
+	CountSourceList CountSource = "list"
+)
+
+// Config holds the settings of the pod computation
+type Config struct {
+	ScaleOnRunning  bool               // Whether running workflows count toward expected pods, not just enqueued ones
+	MinPods         int                // Floor on the expected pods, 0 to let the deployment scale to zero when idle
+	MaxPods         int                // Ceiling on the expected pods, 0 for unlimited
+	PageSize        int                // Workflows listed at a time, bounding the memory of a computation (default 1000)
+	ExcludedQueues  []string           // Queues reported in the metrics but left out of the overall expected pods
+	QueueWeights    map[string]float64 // Multipliers of the queue backlogs, for queues with heavier workflows (default 1)
+	Mode            ScaleMode          // Scaling computation, a registered Scaler, ScaleModeBacklog when empty
+	AverageDuration time.Duration      // Average workflow duration, required by ScaleModeLatency
+	TargetDrainTime time.Duration      // Time within which to drain the backlog, required by ScaleModeLatency
+	CountSource     CountSource        // Origin of the workflow counts, CountSourceAuto when empty
+	StaleCountsAge  time.Duration      // Age up to which the last listed counts stand in for a failed listing, 0 to never
+}
+
+// Computer computes the queue metrics and expected pods from its metadata source and workflow lister
+type Computer struct {
+	metadata  MetadataSource
+	workflows WorkflowLister
+	config    atomic.Pointer[Config]
+
+	// metadataCounts is whether the last fetched metadata had counts for every queue, in which case
+	// CountSourceAuto fetches it before deciding to list the workflows rather than concurrently
+	metadataCounts atomic.Bool
+
+	mu           sync.Mutex
+	listedCounts map[string]*queueCounts // Last listed counts, nil before the first successful listing
+	listedAt     time.Time
+}
+
+// NewComputer returns a Computer reading from the given metadata source and workflow lister
+func NewComputer(metadata MetadataSource, workflows WorkflowLister, config Config) *Computer {
+	c := &Computer{
+		metadata:  metadata,
+		workflows: workflows,
+	}
+	c.config.Store(&config)
+	return c
+}
+
+// SetConfig replaces the settings of the computations started afterwards
+func (c *Computer) SetConfig(config Config) {
+	c.config.Store(&config)
+}
+
+// QueueMetrics returns, for every queue registered with DBOS, its length, worker concurrency
+// and the number of pods required to process all its workflows concurrently
+func (c *Computer) QueueMetrics(ctx context.Context, forceRefresh bool) (map[string]QueueMetric, error) {
+	queuesMetadata, counts, err := c.gather(ctx, forceRefresh)
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	scaler := newScaler(*c.config.Load())
+	metrics := make(map[string]QueueMetric, len(queuesMetadata))
+	for _, queue := range queuesMetadata {
+		count := counts[queue.Name]
+		if count == nil {
+			count = &queueCounts{}
+		}
+		metric := QueueMetric{
+			QueueLength:       count.enqueued + count.running,
+			EnqueuedCount:     count.enqueued,
+			RunningCount:      count.running,
+			WorkerConcurrency: queue.WorkerConcurrency,
+			GlobalConcurrency: queue.GlobalConcurrency,
+			Excluded:          slices.Contains(c.config.Load().ExcludedQueues, queue.Name),
+		}
+		if count.age > 0 {
+			metric.CountsAgeSeconds = count.age.Seconds()
+		}
+		if !count.oldestEnqueued.IsZero() {
+			metric.OldestAgeSeconds = max(now.Sub(count.oldestEnqueued).Seconds(), 0)
+		}
+		if queue.PriorityEnabled && count.enqueued > 0 {
+			metric.EnqueuedByPriority = count.enqueuedByPriority
+		}
+		metric.ExpectedPods = scaler.ComputePods(c.snapshot(queue.Name, metric))
+		// Pods beyond those needed to run the global limit of concurrent workflows would stay idle
+		if metric.WorkerConcurrency > 0 && metric.GlobalConcurrency > 0 {
+			metric.ExpectedPods = min(metric.ExpectedPods, ceilDiv(metric.GlobalConcurrency, metric.WorkerConcurrency))
+		}
+		metric.ActiveSlots = metric.RunningCount
+		metric.TotalSlots = metric.WorkerConcurrency * metric.ExpectedPods
+		if metric.GlobalConcurrency > 0 {
+			metric.TotalSlots = min(metric.TotalSlots, metric.GlobalConcurrency)
+		}
+		metrics[queue.Name] = metric
+	}
+	return metrics, nil
+}
+
+// weight returns the configured weight of the queue, 1 by default
+func (c *Computer) weight(queueName string) float64 {
+	if weight, ok := c.config.Load().QueueWeights[queueName]; ok && weight > 0 {
+		return weight
+	}
+	return 1
+}
+
+// backlog returns the workflows of the queue that count toward its pods
+func (c *Computer) backlog(metric QueueMetric) int {
+	if !c.config.Load().ScaleOnRunning {
+		return metric.EnqueuedCount
+	}
+	return metric.QueueLength
+}
+
+// weightedBacklog returns the backlog of the queue multiplied by its weight, rounded up
+func (c *Computer) weightedBacklog(queueName string, metric QueueMetric) int {
+	return int(math.Ceil(float64(c.backlog(metric)) * c.weight(queueName)))
+}
+
+// snapshot returns the inputs of the queue's Scaler
+func (c *Computer) snapshot(queueName string, metric QueueMetric) QueueSnapshot {
+	return QueueSnapshot{
+		Name:              queueName,
+		EnqueuedCount:     metric.EnqueuedCount,
+		RunningCount:      metric.RunningCount,
+		Backlog:           c.weightedBacklog(queueName, metric),
+		WorkerConcurrency: metric.WorkerConcurrency,
+		GlobalConcurrency: metric.GlobalConcurrency,
+		OldestAgeSeconds:  metric.OldestAgeSeconds,
+	}
+}
+
+// queueCounts holds the number of queued workflows of a queue by status
+type queueCounts struct {
+	enqueued           int
+	running            int
+	enqueuedByPriority map[int]int   // Only when counted from the listed workflows
+	oldestEnqueued     time.Time     // Creation of the oldest enqueued workflow, only when counted from the listed workflows
+	age                time.Duration // Age of the last listed counts standing in for a failed listing, 0 when fresh
+}
+
+// gather fetches the queue metadata and counts the workflows of each queue from the source selected
+// by Config.CountSource. When the counts may come from listing the workflows, the listing runs
+// concurrently with the metadata fetch rather than once the metadata lacks counts. A failed metadata
+// fetch fails the computation, the worker concurrency being unknown, while a failed listing falls back
+// on the last listed counts up to Config.StaleCountsAge.
+func (c *Computer) gather(ctx context.Context, forceRefresh bool) ([]QueueMetadata, map[string]*queueCounts, error) {
+	countSource := c.config.Load().CountSource
+	if countSource == CountSourceAdmin || (countSource != CountSourceList && c.metadataCounts.Load()) {
+		queuesMetadata, err := c.fetchMetadata(ctx, forceRefresh)
+		if err != nil {
+			return nil, nil, err
+		}
+		counts, err := c.queueCounts(ctx, queuesMetadata)
+		return queuesMetadata, counts, err
+	}
+
+	var queuesMetadata []QueueMetadata
+	var listed map[string]*queueCounts
+	var listErr error
+	group, groupCtx := errgroup.WithContext(ctx)
+	group.Go(func() error {
+		var err error
+		queuesMetadata, err = c.fetchMetadata(groupCtx, forceRefresh)
+		return err
+	})
+	group.Go(func() error {
+		// A failed listing does not cancel the metadata fetch, whose counts may stand in
+		listed, listErr = c.listCounts(groupCtx)
+		return nil
+	})
+	if err := group.Wait(); err != nil {
+		return nil, nil, err
+	}
+	if countSource != CountSourceList {
+		if counts, _ := metadataCounts(queuesMetadata); counts != nil {
+			return queuesMetadata, counts, nil
+		}
+	}
+	return queuesMetadata, listed, listErr
+}
+
+// fetchMetadata fetches the queue metadata, recording whether it has counts for every queue
+func (c *Computer) fetchMetadata(ctx context.Context, forceRefresh bool) ([]QueueMetadata, error) {
+	queuesMetadata, err := c.metadata.QueueMetadata(ctx, forceRefresh)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrMetadataUnavailable, err)
+	}
+	counts, _ := metadataCounts(queuesMetadata)
+	c.metadataCounts.Store(counts != nil)
+	return queuesMetadata, nil
+}
+
+// metadataCounts returns the counts of the queue metadata, or nil and the first queue without counts
+func metadataCounts(queuesMetadata []QueueMetadata) (map[string]*queueCounts, string) {
+	counts := make(map[string]*queueCounts, len(queuesMetadata))
+	for _, queue := range queuesMetadata {
+		if queue.EnqueuedCount == nil || queue.RunningCount == nil {
+			return nil, queue.Name
+		}
+		counts[queue.Name] = &queueCounts{enqueued: *queue.EnqueuedCount, running: *queue.RunningCount}
+	}
+	return counts, ""
+}
+
+// queueCounts counts the workflows of each queue from the source selected by Config.CountSource
+func (c *Computer) queueCounts(ctx context.Context, queuesMetadata []QueueMetadata) (map[string]*queueCounts, error) {
+	countSource := c.config.Load().CountSource
+	if countSource == CountSourceList {
+		return c.listCounts(ctx)
+	}
+	counts, uncounted := metadataCounts(queuesMetadata)
+	if counts != nil {
+		return counts, nil
+	}
+	if countSource == CountSourceAdmin {
+		return nil, fmt.Errorf("%w: no workflow counts for queue %s", ErrMetadataUnavailable, uncounted)
+	}
+	return c.listCounts(ctx)
+}
+
+// listCounts counts the listed workflows of each queue, falling back on the last listed counts up to
+// Config.StaleCountsAge when the listing fails
+func (c *Computer) listCounts(ctx context.Context) (map[string]*queueCounts, error) {
+	counts, err := c.countQueuedWorkflows(ctx)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if err == nil {
+		c.listedCounts, c.listedAt = counts, time.Now()
+		return counts, nil
+	}
+	maxAge := c.config.Load().StaleCountsAge
+	if age := time.Since(c.listedAt); c.listedCounts != nil && maxAge > 0 && age <= maxAge {
+		slog.Warn("Serving stale workflow counts", "age", age.Round(time.Millisecond).String(), "error", err)
+		stale := make(map[string]*queueCounts, len(c.listedCounts))
+		for name, count := range c.listedCounts {
+			staleCount := *count
+			staleCount.age = age
+			stale[name] = &staleCount
+		}
+		return stale, nil
+	}
+	return nil, err
+}
+
+// countQueuedWorkflows counts the ENQUEUED and PENDING workflows of each queue, listing them page by page
+// so that memory stays proportional to the number of queues rather than of workflows. Workflows changing
+// status between pages may be missed or counted twice, which the next scrape corrects.
+func (c *Computer) countQueuedWorkflows(ctx context.Context) (map[string]*queueCounts, error) {
+	pageSize := c.config.Load().PageSize
+	if pageSize <= 0 {
+		pageSize = defaultPageSize
+	}
+	counts := make(map[string]*queueCounts)
+	for offset := 0; ; offset += pageSize {
+		workflows, err := c.workflows.ListQueuedWorkflows(ctx, offset, pageSize)
+		if err != nil {
+			return nil, fmt.Errorf("listing queued workflows: %w", err)
+		}
+		for _, workflow := range workflows {
+			queue, ok := counts[workflow.QueueName]
+			if !ok {
+				queue = &queueCounts{enqueuedByPriority: make(map[int]int)}
+				counts[workflow.QueueName] = queue
+			}
+			if workflow.Status == dbos.WorkflowStatusEnqueued {
+				queue.enqueued++
+				queue.enqueuedByPriority[workflow.Priority]++
+				if queue.oldestEnqueued.IsZero() || workflow.CreatedAt.Before(queue.oldestEnqueued) {
+					queue.oldestEnqueued = workflow.CreatedAt
+				}
+			} else {
+				queue.running++
+			}
+		}
+		if len(workflows) < pageSize {
+			return counts, nil
+		}
+	}
+}
+
+// ExpectedPods returns the number of pods required by the most demanding queue that is not excluded,
+// raised to the configured floor and clamped to the configured ceiling. It also reports whether the ceiling was hit.
+func (c *Computer) ExpectedPods(metrics map[string]QueueMetric) (int, bool) {
+	config := c.config.Load()
+	maxExpectedPods := config.MinPods
+	for _, metric := range metrics {
+		if metric.Excluded {
+			continue
+		}
+		maxExpectedPods = max(maxExpectedPods, metric.ExpectedPods)
+	}
+	if config.MaxPods > 0 && maxExpectedPods > config.MaxPods {
+		return config.MaxPods, true
+	}
+	return maxExpectedPods, false
+}
+
+// QueueExplanation details how the expected pods of a queue were computed
+type QueueExplanation struct {
+	Backlog           int     `json:"backlog"`
+	BacklogSource     string  `json:"backlog_source"` // "queue_length", or "enqueued_count" when running workflows are not counted
+	Weight            float64 `json:"weight"`
+	WeightedBacklog   int     `json:"weighted_backlog"` // ceil(backlog * weight), from which the pods are computed
+	WorkerConcurrency int     `json:"worker_concurrency"`
+	CeilPods          int     `json:"ceil_pods"`                 // Pods the weighted backlog requires under the scale mode
+	GlobalCapPods     int     `json:"global_cap_pods,omitempty"` // ceil(global_concurrency / worker_concurrency), when a global concurrency is set
+	ExpectedPods      int     `json:"expected_pods"`
+	ActiveSlots       int     `json:"active_slots"`
+	TotalSlots        int     `json:"total_slots"`
+	Excluded          bool    `json:"excluded,omitempty"`
+}
+
+// Explanation details how ExpectedPods derives the expected pods from the queue metrics
+type Explanation struct {
+	Mode         ScaleMode                   `json:"mode"`
+	Queues       map[string]QueueExplanation `json:"queues"`
+	MaxQueue     string                      `json:"max_queue,omitempty"` // Queue requiring the most pods, none if all require 0
+	MaxQueuePods int                         `json:"max_queue_pods"`
+	MinPods      int                         `json:"min_pods"`
+	MaxPods      int                         `json:"max_pods,omitempty"`
+	ExpectedPods int                         `json:"expected_pods"`
+	Capped       bool                        `json:"capped"`
+}
+
+// Explain breaks down the computation of the expected pods from the queue metrics
+func (c *Computer) Explain(metrics map[string]QueueMetric) Explanation {
+	config := c.config.Load()
+	explanation := Explanation{
+		Mode:    config.Mode,
+		Queues:  make(map[string]QueueExplanation, len(metrics)),
+		MinPods: config.MinPods,
+		MaxPods: config.MaxPods,
+	}
+	backlogSource := "queue_length"
+	if !config.ScaleOnRunning {
+		backlogSource = "enqueued_count"
+	}
+	scaler := newScaler(*config)
+	for name, metric := range metrics {
+		queue := QueueExplanation{
+			Backlog:           c.backlog(metric),
+			BacklogSource:     backlogSource,
+			Weight:            c.weight(name),
+			WeightedBacklog:   c.weightedBacklog(name, metric),
+			WorkerConcurrency: metric.WorkerConcurrency,
+			ExpectedPods:      metric.ExpectedPods,
+			ActiveSlots:       metric.ActiveSlots,
+			TotalSlots:        metric.TotalSlots,
+			Excluded:          metric.Excluded,
+		}
+		queue.CeilPods = scaler.ComputePods(c.snapshot(name, metric))
+		if metric.WorkerConcurrency > 0 && metric.GlobalConcurrency > 0 {
+			queue.GlobalCapPods = ceilDiv(metric.GlobalConcurrency, metric.WorkerConcurrency)
+		}
+		explanation.Queues[name] = queue
+
+		if metric.Excluded {
+			continue
+		}
+		// Break ties alphabetically so that the explanation is stable across requests
+		if metric.ExpectedPods > explanation.MaxQueuePods ||
+			(metric.ExpectedPods > 0 && metric.ExpectedPods == explanation.MaxQueuePods && name < explanation.MaxQueue) {
+			explanation.MaxQueue = name
+			explanation.MaxQueuePods = metric.ExpectedPods
+		}
+	}
+	explanation.ExpectedPods, explanation.Capped = c.ExpectedPods(metrics)
+	return explanation
+}
+
+func ceilDiv(a, b int) int {
+	return (a + b - 1) / b
+}
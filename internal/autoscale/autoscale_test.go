@@ -0,0 +1,550 @@
+package autoscale
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/dbos-inc/dbos-transact-golang/dbos"
+)
+
+type fakeMetadataSource []QueueMetadata
+
+func (f fakeMetadataSource) QueueMetadata(context.Context, bool) ([]QueueMetadata, error) {
+	return f, nil
+}
+
+type fakeWorkflowLister []dbos.WorkflowStatus
+
+func (f fakeWorkflowLister) ListQueuedWorkflows(_ context.Context, offset, limit int) ([]dbos.WorkflowStatus, error) {
+	if offset >= len(f) {
+		return nil, nil
+	}
+	return f[offset:min(offset+limit, len(f))], nil
+}
+
+// queuedWorkflows returns n ENQUEUED workflows on the given queue
+func queuedWorkflows(queueName string, n int) []dbos.WorkflowStatus {
+	workflows := make([]dbos.WorkflowStatus, n)
+	for i := range workflows {
+		workflows[i] = dbos.WorkflowStatus{QueueName: queueName, Status: dbos.WorkflowStatusEnqueued}
+	}
+	return workflows
+}
+
+func TestExpectedPods(t *testing.T) {
+	tests := []struct {
+		name       string
+		queues     []QueueMetadata
+		workflows  []dbos.WorkflowStatus
+		config     Config
+		wantPods   int
+		wantCapped bool
+	}{
+		{
+			name:     "no queues",
+			config:   Config{MinPods: 1},
+			wantPods: 1,
+		},
+		{
+			name:     "empty queue",
+			queues:   []QueueMetadata{{Name: "q", WorkerConcurrency: 2}},
+			config:   Config{MinPods: 1},
+			wantPods: 1,
+		},
+		{
+			name:     "empty queue scales to zero",
+			queues:   []QueueMetadata{{Name: "q", WorkerConcurrency: 2}},
+			wantPods: 0,
+		},
+		{
+			name:      "warm floor",
+			queues:    []QueueMetadata{{Name: "q", WorkerConcurrency: 2}},
+			workflows: queuedWorkflows("q", 2),
+			config:    Config{MinPods: 2},
+			wantPods:  2,
+		},
+		{
+			name:      "single workflow without floor",
+			queues:    []QueueMetadata{{Name: "q", WorkerConcurrency: 2}},
+			workflows: queuedWorkflows("q", 1),
+			wantPods:  1,
+		},
+		{
+			name:      "exactly divisible",
+			queues:    []QueueMetadata{{Name: "q", WorkerConcurrency: 2}},
+			workflows: queuedWorkflows("q", 6),
+			wantPods:  3,
+		},
+		{
+			name:      "ceil rounds up",
+			queues:    []QueueMetadata{{Name: "q", WorkerConcurrency: 2}},
+			workflows: queuedWorkflows("q", 7),
+			wantPods:  4,
+		},
+		{
+			name:      "zero concurrency queue needs a single pod",
+			queues:    []QueueMetadata{{Name: "q", WorkerConcurrency: 0}},
+			workflows: queuedWorkflows("q", 7),
+			wantPods:  1,
+		},
+		{
+			name:      "zero concurrency queue keeps a pod without a floor",
+			queues:    []QueueMetadata{{Name: "q", WorkerConcurrency: 0, GlobalConcurrency: 3}},
+			workflows: queuedWorkflows("q", 7),
+			config:    Config{MinPods: 0},
+			wantPods:  1,
+		},
+		{
+			name:      "max across queues wins",
+			queues:    []QueueMetadata{{Name: "a", WorkerConcurrency: 1}, {Name: "b", WorkerConcurrency: 5}},
+			workflows: append(queuedWorkflows("a", 3), queuedWorkflows("b", 20)...),
+			wantPods:  4,
+		},
+		{
+			name:      "bounded by global concurrency",
+			queues:    []QueueMetadata{{Name: "q", WorkerConcurrency: 2, GlobalConcurrency: 5}},
+			workflows: queuedWorkflows("q", 20),
+			wantPods:  3,
+		},
+		{
+			name:      "global concurrency above backlog",
+			queues:    []QueueMetadata{{Name: "q", WorkerConcurrency: 2, GlobalConcurrency: 50}},
+			workflows: queuedWorkflows("q", 6),
+			wantPods:  3,
+		},
+		{
+			name:       "clamped to max pods",
+			queues:     []QueueMetadata{{Name: "q", WorkerConcurrency: 1}},
+			workflows:  queuedWorkflows("q", 10),
+			config:     Config{MaxPods: 4},
+			wantPods:   4,
+			wantCapped: true,
+		},
+		{
+			name:      "below max pods",
+			queues:    []QueueMetadata{{Name: "q", WorkerConcurrency: 1}},
+			workflows: queuedWorkflows("q", 3),
+			config:    Config{MaxPods: 4},
+			wantPods:  3,
+		},
+		{
+			name:      "excluded queue ignored",
+			queues:    []QueueMetadata{{Name: "a", WorkerConcurrency: 1}, {Name: "background", WorkerConcurrency: 1}},
+			workflows: append(queuedWorkflows("a", 2), queuedWorkflows("background", 20)...),
+			config:    Config{ExcludedQueues: []string{"background"}},
+			wantPods:  2,
+		},
+		{
+			name:      "weighted queue",
+			queues:    []QueueMetadata{{Name: "light", WorkerConcurrency: 2}, {Name: "heavy", WorkerConcurrency: 2}},
+			workflows: append(queuedWorkflows("light", 6), queuedWorkflows("heavy", 3)...),
+			config:    Config{ScaleOnRunning: true, QueueWeights: map[string]float64{"heavy": 2.5}},
+			wantPods:  4,
+		},
+		{
+			name:      "latency mode drains within the target",
+			queues:    []QueueMetadata{{Name: "q", WorkerConcurrency: 2}},
+			workflows: queuedWorkflows("q", 100),
+			config:    Config{Mode: ScaleModeLatency, AverageDuration: 10 * time.Second, TargetDrainTime: 100 * time.Second},
+			wantPods:  5,
+		},
+		{
+			name:      "latency mode target shorter than a workflow",
+			queues:    []QueueMetadata{{Name: "q", WorkerConcurrency: 2}},
+			workflows: queuedWorkflows("q", 10),
+			config:    Config{Mode: ScaleModeLatency, AverageDuration: time.Minute, TargetDrainTime: 30 * time.Second},
+			wantPods:  5,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			computer := NewComputer(fakeMetadataSource(tt.queues), fakeWorkflowLister(tt.workflows), tt.config)
+			metrics, err := computer.QueueMetrics(context.Background(), false)
+			if err != nil {
+				t.Fatalf("QueueMetrics: %v", err)
+			}
+			pods, capped := computer.ExpectedPods(metrics)
+			if pods != tt.wantPods || capped != tt.wantCapped {
+				t.Errorf("ExpectedPods = (%d, %t), want (%d, %t)", pods, capped, tt.wantPods, tt.wantCapped)
+			}
+		})
+	}
+}
+
+func TestQueueMetricsRunningWorkflows(t *testing.T) {
+	queues := []QueueMetadata{{Name: "q", WorkerConcurrency: 2}}
+	workflows := append(queuedWorkflows("q", 1), dbos.WorkflowStatus{QueueName: "q", Status: dbos.WorkflowStatusPending}, dbos.WorkflowStatus{QueueName: "q", Status: dbos.WorkflowStatusPending})
+
+	for _, tt := range []struct {
+		scaleOnRunning bool
+		wantPods       int
+		wantSlots      int
+	}{
+		{scaleOnRunning: true, wantPods: 2, wantSlots: 4},
+		{scaleOnRunning: false, wantPods: 1, wantSlots: 2},
+	} {
+		computer := NewComputer(fakeMetadataSource(queues), fakeWorkflowLister(workflows), Config{ScaleOnRunning: tt.scaleOnRunning})
+		metrics, err := computer.QueueMetrics(context.Background(), false)
+		if err != nil {
+			t.Fatalf("QueueMetrics: %v", err)
+		}
+		want := QueueMetric{QueueLength: 3, EnqueuedCount: 1, RunningCount: 2, WorkerConcurrency: 2, ExpectedPods: tt.wantPods, ActiveSlots: 2, TotalSlots: tt.wantSlots}
+		if !reflect.DeepEqual(metrics["q"], want) {
+			t.Errorf("ScaleOnRunning=%t: metrics = %+v, want %+v", tt.scaleOnRunning, metrics["q"], want)
+		}
+	}
+}
+
+func TestQueueMetricsPagination(t *testing.T) {
+	queues := []QueueMetadata{{Name: "a", WorkerConcurrency: 1}, {Name: "b", WorkerConcurrency: 1}}
+	workflows := append(queuedWorkflows("a", 7), queuedWorkflows("b", 3)...)
+
+	// Page sizes dividing the workflows evenly, unevenly, and exceeding them
+	for _, pageSize := range []int{1, 5, 3, 100} {
+		computer := NewComputer(fakeMetadataSource(queues), fakeWorkflowLister(workflows), Config{ScaleOnRunning: true, PageSize: pageSize})
+		metrics, err := computer.QueueMetrics(context.Background(), false)
+		if err != nil {
+			t.Fatalf("QueueMetrics: %v", err)
+		}
+		if metrics["a"].QueueLength != 7 || metrics["b"].QueueLength != 3 {
+			t.Errorf("PageSize=%d: queue lengths = (%d, %d), want (7, 3)", pageSize, metrics["a"].QueueLength, metrics["b"].QueueLength)
+		}
+	}
+}
+
+func TestQueueMetricsPriorities(t *testing.T) {
+	queues := []QueueMetadata{{Name: "q", WorkerConcurrency: 1, PriorityEnabled: true}, {Name: "plain", WorkerConcurrency: 1}}
+	workflows := []dbos.WorkflowStatus{
+		{QueueName: "q", Status: dbos.WorkflowStatusEnqueued, Priority: 1},
+		{QueueName: "q", Status: dbos.WorkflowStatusEnqueued, Priority: 1},
+		{QueueName: "q", Status: dbos.WorkflowStatusEnqueued, Priority: 5},
+		{QueueName: "q", Status: dbos.WorkflowStatusPending, Priority: 5},
+		{QueueName: "plain", Status: dbos.WorkflowStatusEnqueued},
+	}
+
+	computer := NewComputer(fakeMetadataSource(queues), fakeWorkflowLister(workflows), Config{ScaleOnRunning: true})
+	metrics, err := computer.QueueMetrics(context.Background(), false)
+	if err != nil {
+		t.Fatalf("QueueMetrics: %v", err)
+	}
+	if want := map[int]int{1: 2, 5: 1}; !reflect.DeepEqual(metrics["q"].EnqueuedByPriority, want) {
+		t.Errorf("EnqueuedByPriority = %v, want %v", metrics["q"].EnqueuedByPriority, want)
+	}
+	if metrics["plain"].EnqueuedByPriority != nil {
+		t.Errorf("EnqueuedByPriority of a queue without priorities = %v, want nil", metrics["plain"].EnqueuedByPriority)
+	}
+}
+
+func TestQueueMetricsCountSource(t *testing.T) {
+	enqueued, running := 9, 1
+	counted := []QueueMetadata{{Name: "q", WorkerConcurrency: 1, EnqueuedCount: &enqueued, RunningCount: &running}}
+	uncounted := []QueueMetadata{{Name: "q", WorkerConcurrency: 1}}
+	listed := queuedWorkflows("q", 3)
+
+	for _, tt := range []struct {
+		name       string
+		queues     []QueueMetadata
+		source     CountSource
+		wantLength int
+		wantErr    bool
+	}{
+		{name: "auto with counts", queues: counted, wantLength: 10},
+		{name: "auto without counts", queues: uncounted, wantLength: 3},
+		{name: "list ignores counts", queues: counted, source: CountSourceList, wantLength: 3},
+		{name: "admin with counts", queues: counted, source: CountSourceAdmin, wantLength: 10},
+		{name: "admin without counts", queues: uncounted, source: CountSourceAdmin, wantErr: true},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			computer := NewComputer(fakeMetadataSource(tt.queues), fakeWorkflowLister(listed), Config{CountSource: tt.source})
+			metrics, err := computer.QueueMetrics(context.Background(), false)
+			if tt.wantErr {
+				if !errors.Is(err, ErrMetadataUnavailable) {
+					t.Errorf("QueueMetrics error = %v, want ErrMetadataUnavailable", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("QueueMetrics: %v", err)
+			}
+			if metrics["q"].QueueLength != tt.wantLength {
+				t.Errorf("queue length = %d, want %d", metrics["q"].QueueLength, tt.wantLength)
+			}
+		})
+	}
+}
+
+func TestQueueMetricsOldestAge(t *testing.T) {
+	queues := []QueueMetadata{{Name: "q", WorkerConcurrency: 2}, {Name: "empty", WorkerConcurrency: 2}}
+	now := time.Now()
+	workflows := []dbos.WorkflowStatus{
+		{QueueName: "q", Status: dbos.WorkflowStatusEnqueued, CreatedAt: now.Add(-30 * time.Second)},
+		{QueueName: "q", Status: dbos.WorkflowStatusEnqueued, CreatedAt: now.Add(-90 * time.Second)},
+		// Running workflows are not waiting anymore
+		{QueueName: "q", Status: dbos.WorkflowStatusPending, CreatedAt: now.Add(-time.Hour)},
+	}
+
+	computer := NewComputer(fakeMetadataSource(queues), fakeWorkflowLister(workflows), Config{ScaleOnRunning: true})
+	metrics, err := computer.QueueMetrics(context.Background(), false)
+	if err != nil {
+		t.Fatalf("QueueMetrics: %v", err)
+	}
+	if age := metrics["q"].OldestAgeSeconds; age < 90 || age > 91 {
+		t.Errorf("oldest age of q = %.1fs, want 90s", age)
+	}
+	if age := metrics["empty"].OldestAgeSeconds; age != 0 {
+		t.Errorf("oldest age of the empty queue = %.1fs, want 0", age)
+	}
+}
+
+func TestQueueMetricsSlots(t *testing.T) {
+	queues := []QueueMetadata{
+		{Name: "capped", WorkerConcurrency: 2, GlobalConcurrency: 3},
+		{Name: "unlimited"},
+	}
+	workflows := append(queuedWorkflows("capped", 3), queuedWorkflows("unlimited", 2)...)
+	workflows = append(workflows, dbos.WorkflowStatus{QueueName: "capped", Status: dbos.WorkflowStatusPending})
+
+	computer := NewComputer(fakeMetadataSource(queues), fakeWorkflowLister(workflows), Config{ScaleOnRunning: true})
+	metrics, err := computer.QueueMetrics(context.Background(), false)
+	if err != nil {
+		t.Fatalf("QueueMetrics: %v", err)
+	}
+	// 2 pods of 2 slots, capped by the global concurrency
+	if got := metrics["capped"]; got.ActiveSlots != 1 || got.TotalSlots != 3 {
+		t.Errorf("capped queue: %d of %d slots active, want 1 of 3", got.ActiveSlots, got.TotalSlots)
+	}
+	if got := metrics["unlimited"]; got.ActiveSlots != 0 || got.TotalSlots != 0 {
+		t.Errorf("queue without worker concurrency: %d of %d slots active, want 0 of 0", got.ActiveSlots, got.TotalSlots)
+	}
+}
+
+// rendezvous is a metadata source and workflow lister that each wait for the other to be called, and
+// fail if it is not within a second: they only succeed when called concurrently
+type rendezvous struct {
+	metadataCalled chan struct{}
+	listingCalled  chan struct{}
+}
+
+func (r rendezvous) QueueMetadata(context.Context, bool) ([]QueueMetadata, error) {
+	close(r.metadataCalled)
+	select {
+	case <-r.listingCalled:
+		return []QueueMetadata{{Name: "q", WorkerConcurrency: 1}}, nil
+	case <-time.After(time.Second):
+		return nil, errors.New("the workflows were not listed concurrently")
+	}
+}
+
+func (r rendezvous) ListQueuedWorkflows(_ context.Context, offset, _ int) ([]dbos.WorkflowStatus, error) {
+	if offset > 0 {
+		return nil, nil
+	}
+	close(r.listingCalled)
+	select {
+	case <-r.metadataCalled:
+		return queuedWorkflows("q", 2), nil
+	case <-time.After(time.Second):
+		return nil, errors.New("the metadata was not fetched concurrently")
+	}
+}
+
+func TestQueueMetricsConcurrentGathering(t *testing.T) {
+	for _, source := range []CountSource{CountSourceAuto, CountSourceList} {
+		r := rendezvous{metadataCalled: make(chan struct{}), listingCalled: make(chan struct{})}
+		computer := NewComputer(r, r, Config{CountSource: source, PageSize: 10})
+		metrics, err := computer.QueueMetrics(context.Background(), false)
+		if err != nil {
+			t.Fatalf("CountSource=%q: QueueMetrics: %v", source, err)
+		}
+		if got := metrics["q"].ExpectedPods; got != 2 {
+			t.Errorf("CountSource=%q: expected pods = %d, want 2", source, got)
+		}
+	}
+}
+
+type failingWorkflowLister struct {
+	workflows []dbos.WorkflowStatus
+	err       error // Returned instead of the workflows when set
+}
+
+func (f *failingWorkflowLister) ListQueuedWorkflows(ctx context.Context, offset, limit int) ([]dbos.WorkflowStatus, error) {
+	if f.err != nil {
+		return nil, f.err
+	}
+	return fakeWorkflowLister(f.workflows).ListQueuedWorkflows(ctx, offset, limit)
+}
+
+func TestQueueMetricsStaleCounts(t *testing.T) {
+	queues := fakeMetadataSource{{Name: "q", WorkerConcurrency: 1}}
+	for _, tt := range []struct {
+		name           string
+		staleCountsAge time.Duration
+		wait           time.Duration
+		wantStale      bool
+	}{
+		{name: "fallback", staleCountsAge: time.Minute, wantStale: true},
+		{name: "fallback disabled"},
+		{name: "expired", staleCountsAge: 10 * time.Millisecond, wait: 20 * time.Millisecond},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			lister := &failingWorkflowLister{workflows: queuedWorkflows("q", 3)}
+			computer := NewComputer(queues, lister, Config{StaleCountsAge: tt.staleCountsAge})
+			if metrics, err := computer.QueueMetrics(context.Background(), false); err != nil || metrics["q"].CountsAgeSeconds != 0 {
+				t.Fatalf("healthy computation: %+v, %v, want fresh counts", metrics["q"], err)
+			}
+
+			time.Sleep(tt.wait)
+			lister.err = errors.New("database down")
+			metrics, err := computer.QueueMetrics(context.Background(), false)
+			if !tt.wantStale {
+				if err == nil {
+					t.Errorf("computation during the outage = %+v, want an error", metrics["q"])
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("computation during the outage: %v", err)
+			}
+			if got := metrics["q"]; got.QueueLength != 3 || got.ExpectedPods != 3 || got.CountsAgeSeconds <= 0 {
+				t.Errorf("metrics during the outage = %+v, want the last 3 workflows, flagged stale", got)
+			}
+		})
+	}
+
+	// Without metadata, the worker concurrency is unknown whatever the listing
+	computer := NewComputer(failingMetadataSource{}, fakeWorkflowLister(queuedWorkflows("q", 3)), Config{StaleCountsAge: time.Minute})
+	if _, err := computer.QueueMetrics(context.Background(), false); !errors.Is(err, ErrMetadataUnavailable) {
+		t.Errorf("QueueMetrics error = %v, want ErrMetadataUnavailable", err)
+	}
+}
+
+type failingMetadataSource struct{}
+
+func (failingMetadataSource) QueueMetadata(context.Context, bool) ([]QueueMetadata, error) {
+	return nil, errors.New("connection refused")
+}
+
+func TestScalers(t *testing.T) {
+	latency := latencyScaler{averageDuration: 10 * time.Second, targetDrainTime: 100 * time.Second}
+	tests := []struct {
+		name     string
+		scaler   Scaler
+		snapshot QueueSnapshot
+		wantPods int
+	}{
+		{"backlog", backlogScaler{}, QueueSnapshot{Backlog: 7, WorkerConcurrency: 2}, 4},
+		{"backlog without worker concurrency", backlogScaler{}, QueueSnapshot{Backlog: 7}, 1},
+		{"backlog empty", backlogScaler{}, QueueSnapshot{WorkerConcurrency: 2}, 0},
+		// A pod drains 2 * 100s / 10s = 20 workflows within the target
+		{"latency", latency, QueueSnapshot{Backlog: 50, WorkerConcurrency: 2}, 3},
+		{"latency never above backlog", latencyScaler{averageDuration: time.Minute, targetDrainTime: time.Second}, QueueSnapshot{Backlog: 5, WorkerConcurrency: 2}, 3},
+		{"latency without worker concurrency", latency, QueueSnapshot{Backlog: 50}, 1},
+	}
+	for _, tt := range tests {
+		if got := tt.scaler.ComputePods(tt.snapshot); got != tt.wantPods {
+			t.Errorf("%s: ComputePods(%+v) = %d, want %d", tt.name, tt.snapshot, got, tt.wantPods)
+		}
+	}
+}
+
+// oldestAgeScaler requests a pod per started minute of the oldest enqueued workflow's age
+type oldestAgeScaler struct{}
+
+func (oldestAgeScaler) ComputePods(snapshot QueueSnapshot) int {
+	return int(snapshot.OldestAgeSeconds/60) + 1
+}
+
+func TestRegisterScaler(t *testing.T) {
+	const mode ScaleMode = "test-oldest-age"
+	var gotConfig Config
+	RegisterScaler(mode, func(config Config) Scaler {
+		gotConfig = config
+		return oldestAgeScaler{}
+	})
+	defer func() {
+		scalersMu.Lock()
+		delete(scalers, mode)
+		scalersMu.Unlock()
+	}()
+	if modes := ScaleModes(); !reflect.DeepEqual(modes, []ScaleMode{ScaleModeBacklog, ScaleModeLatency, mode}) {
+		t.Errorf("ScaleModes() = %v", modes)
+	}
+
+	workflows := []dbos.WorkflowStatus{{QueueName: "q", Status: dbos.WorkflowStatusEnqueued, CreatedAt: time.Now().Add(-150 * time.Second)}}
+	config := Config{Mode: mode, CountSource: CountSourceList, MaxPods: 10}
+	computer := NewComputer(fakeMetadataSource{{Name: "q", WorkerConcurrency: 5}}, fakeWorkflowLister(workflows), config)
+	metrics, err := computer.QueueMetrics(context.Background(), false)
+	if err != nil {
+		t.Fatalf("QueueMetrics: %v", err)
+	}
+	if got := metrics["q"].ExpectedPods; got != 3 {
+		t.Errorf("expected pods = %d, want 3 for a workflow enqueued 2.5 minutes ago", got)
+	}
+	if gotConfig.Mode != mode || gotConfig.MaxPods != 10 {
+		t.Errorf("factory called with %+v, want the computer's config", gotConfig)
+	}
+	if got := computer.Explain(metrics).Queues["q"].CeilPods; got != 3 {
+		t.Errorf("explained ceil_pods = %d, want 3", got)
+	}
+
+	defer func() {
+		if recover() == nil {
+			t.Error("registering a mode twice did not panic")
+		}
+	}()
+	RegisterScaler(ScaleModeBacklog, func(Config) Scaler { return backlogScaler{} })
+}
+
+func TestDecodeQueueMetadataTolerant(t *testing.T) {
+	two := 2
+	tests := []struct {
+		name    string
+		payload string
+		want    []QueueMetadata
+	}{
+		{
+			name:    "current shape",
+			payload: `[{"name": "a", "workerConcurrency": 2, "concurrency": 5, "maxTasksPerIteration": 100}]`,
+			want:    []QueueMetadata{{Name: "a", WorkerConcurrency: 2, GlobalConcurrency: 5}},
+		},
+		{
+			name:    "current shape with an unnamed entry",
+			payload: `[{"name": "a", "workerConcurrency": 2}, {"workerConcurrency": 1}, {"name": "", "concurrency": 3}]`,
+			want:    []QueueMetadata{{Name: "a", WorkerConcurrency: 2}},
+		},
+		{
+			name: "wrapped, with unexpected types and an unnamed entry",
+			payload: `{"version": "9", "queues": [
+				{"name": "a", "workerConcurrency": "2", "concurrency": 5, "runningCount": 2},
+				{"workerConcurrency": 1},
+				"b",
+				{"name": "c", "priorityEnabled": true, "rateLimit": {"limit": 1}}
+			]}`,
+			want: []QueueMetadata{
+				{Name: "a", GlobalConcurrency: 5, RunningCount: &two},
+				{Name: "c", PriorityEnabled: true},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := decodeQueueMetadata([]byte(tt.payload))
+			if err != nil {
+				t.Fatalf("decodeQueueMetadata: %v", err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("decodeQueueMetadata = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+
+	for _, payload := range []string{`"queues"`, `{"queues": "none"}`, `not json`} {
+		if _, err := decodeQueueMetadata([]byte(payload)); err == nil {
+			t.Errorf("decodeQueueMetadata(%s) succeeded, want an error", payload)
+		}
+	}
+}
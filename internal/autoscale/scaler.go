@@ -0,0 +1,105 @@
+package autoscale
+
+import (
+	"fmt"
+	"math"
+	"slices"
+	"sync"
+	"time"
+)
+
+// QueueSnapshot holds what a Scaler knows of a queue, gathered once per computation
+type QueueSnapshot struct {
+	Name              string
+	EnqueuedCount     int
+	RunningCount      int
+	Backlog           int // Workflows counting toward the pods, per Config.ScaleOnRunning, times the queue weight rounded up
+	WorkerConcurrency int // 0 means no per-worker limit
+	GlobalConcurrency int // 0 means no global limit
+	OldestAgeSeconds  float64
+}
+
+// Scaler computes the pods a queue requires from its snapshot. The Computer then caps them to those
+// the global concurrency can keep busy, and ExpectedPods applies the floor and ceiling.
+type Scaler interface {
+	ComputePods(snapshot QueueSnapshot) int
+}
+
+// ScalerFactory returns the Scaler of a scale mode configured by config
+type ScalerFactory func(config Config) Scaler
+
+var (
+	scalersMu sync.RWMutex
+	scalers   = map[ScaleMode]ScalerFactory{
+		ScaleModeBacklog: func(Config) Scaler { return backlogScaler{} },
+		ScaleModeLatency: func(config Config) Scaler {
+			return latencyScaler{averageDuration: config.AverageDuration, targetDrainTime: config.TargetDrainTime}
+		},
+	}
+)
+
+// RegisterScaler makes the Scaler built by factory selectable with Config.Mode. It panics if the mode
+// is empty or already registered.
+func RegisterScaler(mode ScaleMode, factory ScalerFactory) {
+	scalersMu.Lock()
+	defer scalersMu.Unlock()
+	if mode == "" {
+		panic("autoscale: RegisterScaler with an empty mode")
+	}
+	if _, ok := scalers[mode]; ok {
+		panic(fmt.Sprintf("autoscale: scale mode %q registered twice", mode))
+	}
+	scalers[mode] = factory
+}
+
+// ScaleModes returns the registered scale modes, sorted
+func ScaleModes() []ScaleMode {
+	scalersMu.RLock()
+	defer scalersMu.RUnlock()
+	modes := make([]ScaleMode, 0, len(scalers))
+	for mode := range scalers {
+		modes = append(modes, mode)
+	}
+	slices.Sort(modes)
+	return modes
+}
+
+// newScaler returns the Scaler of the configured mode, the backlog one when the mode is empty or unknown
+func newScaler(config Config) Scaler {
+	scalersMu.RLock()
+	factory, ok := scalers[config.Mode]
+	scalersMu.RUnlock()
+	if !ok {
+		return backlogScaler{}
+	}
+	return factory(config)
+}
+
+// backlogScaler requests enough pods to run the whole backlog at once
+type backlogScaler struct{}
+
+func (backlogScaler) ComputePods(snapshot QueueSnapshot) int {
+	// Without a per-worker limit, a single pod dequeues the whole backlog
+	if snapshot.WorkerConcurrency <= 0 {
+		return min(snapshot.Backlog, 1)
+	}
+	return ceilDiv(snapshot.Backlog, snapshot.WorkerConcurrency)
+}
+
+// latencyScaler requests enough pods to drain the backlog within targetDrainTime, given workflows
+// lasting averageDuration, never more than backlogScaler
+type latencyScaler struct {
+	averageDuration time.Duration
+	targetDrainTime time.Duration
+}
+
+func (s latencyScaler) ComputePods(snapshot QueueSnapshot) int {
+	pods := backlogScaler{}.ComputePods(snapshot)
+	if snapshot.WorkerConcurrency <= 0 {
+		return pods
+	}
+	// A pod completes workerConcurrency workflows per average duration. With a target drain time shorter
+	// than the average duration, more pods than the backlog can occupy would not drain it any faster.
+	perPod := float64(snapshot.WorkerConcurrency) * s.targetDrainTime.Seconds() / s.averageDuration.Seconds()
+	return min(pods, int(math.Ceil(float64(snapshot.Backlog)/perPod)))
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"sync/atomic"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+)
+
+const (
+	// schedulerLockID is the Postgres advisory lock held by the pod running the scheduled workflows
+	schedulerLockID int64 = 0x64626f7373636864 // "dbossched"
+	// leaderCheckInterval is the interval between two attempts to acquire the lock, or checks that it is still held
+	leaderCheckInterval = 10 * time.Second
+)
+
+// leaderElector elects a single leader among the pods through a Postgres advisory lock on the system
+// database. The leader holds the lock on a dedicated connection, so the lock is released when the pod
+// stops or loses the connection, and another pod acquires it at its next attempt.
+type leaderElector struct {
+	connConfig *pgx.ConnConfig
+	lockID     int64
+	interval   time.Duration
+
+	leader atomic.Bool
+}
+
+// newLeaderElector returns an elector competing for the lock over connections configured by connConfig
+func newLeaderElector(connConfig *pgx.ConnConfig, lockID int64) *leaderElector {
+	return &leaderElector{connConfig: connConfig, lockID: lockID, interval: leaderCheckInterval}
+}
+
+// isLeader reports whether this pod currently holds the lock
+func (e *leaderElector) isLeader() bool {
+	return e.leader.Load()
+}
+
+// run competes for the lock until the context is done, then releases it if held
+func (e *leaderElector) run(ctx context.Context) {
+	var conn *pgx.Conn
+	defer func() {
+		if conn != nil {
+			e.leader.Store(false)
+			conn.Close(context.Background())
+		}
+	}()
+
+	ticker := time.NewTicker(e.interval)
+	defer ticker.Stop()
+	for {
+		conn = e.check(ctx, conn)
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// check acquires the lock when not holding it, or verifies that its connection is still alive,
+// and returns the connection holding the lock, if any
+func (e *leaderElector) check(ctx context.Context, conn *pgx.Conn) *pgx.Conn {
+	if conn != nil {
+		if _, err := conn.Exec(ctx, "SELECT 1"); err == nil {
+			return conn
+		} else if ctx.Err() == nil {
+			slog.Warn("Lost the scheduler leadership", "error", err)
+		}
+		e.leader.Store(false)
+		conn.Close(context.Background())
+	}
+
+	conn, err := pgx.ConnectConfig(ctx, e.connConfig)
+	if err != nil {
+		slog.Debug("Connecting to compete for the scheduler leadership failed", "error", err)
+		return nil
+	}
+	var acquired bool
+	if err := conn.QueryRow(ctx, "SELECT pg_try_advisory_lock($1)", e.lockID).Scan(&acquired); err != nil || !acquired {
+		if err != nil {
+			slog.Debug("Acquiring the scheduler lock failed", "error", err)
+		}
+		conn.Close(context.Background())
+		return nil
+	}
+	e.leader.Store(true)
+	slog.Info("Became the scheduler leader")
+	return conn
+}
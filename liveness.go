@@ -0,0 +1,133 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/dbos-inc/dbos-transact-golang/dbos"
+)
+
+// progressWatchdog detects a wedged queue runner: workflows of this application version wait on a
+// queue this executor has capacity for, yet the executor dequeues nothing for longer than the stall
+// timeout. Queues that are empty, saturated on this executor or at their global concurrency are not
+// expected to progress and never count as stalled.
+type progressWatchdog struct {
+	dbosContext  dbos.DBOSContext
+	queues       []dbos.WorkflowQueue
+	interval     time.Duration
+	stallTimeout time.Duration
+
+	mu           sync.Mutex
+	lastProgress time.Time
+	lastPending  []string // IDs of the workflows this executor was running at the last check, sorted
+}
+
+// newProgressWatchdog returns a watchdog checking the queues every interval
+func newProgressWatchdog(dbosContext dbos.DBOSContext, queues []dbos.WorkflowQueue, interval, stallTimeout time.Duration) *progressWatchdog {
+	return &progressWatchdog{
+		dbosContext:  dbosContext,
+		queues:       queues,
+		interval:     interval,
+		stallTimeout: stallTimeout,
+		lastProgress: time.Now(),
+	}
+}
+
+// run checks the queues until the context is cancelled
+func (w *progressWatchdog) run(ctx context.Context) {
+	ticker := time.NewTicker(w.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := w.check(); err != nil {
+				// An unreachable database is the readiness probe's concern, not a stall
+				slog.Warn("Checking workflow progress failed", "error", err)
+			}
+		}
+	}
+}
+
+// check records progress when this executor's running workflows changed or no queue is expected to progress
+func (w *progressWatchdog) check() error {
+	expected := false
+	var pending []string
+	for _, queue := range w.queues {
+		localPending, err := dbos.ListWorkflows(w.dbosContext,
+			dbos.WithQueueName(queue.Name),
+			dbos.WithStatus([]dbos.WorkflowStatusType{dbos.WorkflowStatusPending}),
+			dbos.WithExecutorIDs([]string{w.dbosContext.GetExecutorID()}),
+			dbos.WithLoadInput(false),
+			dbos.WithLoadOutput(false),
+		)
+		if err != nil {
+			return err
+		}
+		for _, workflow := range localPending {
+			pending = append(pending, workflow.ID)
+		}
+
+		if !expected {
+			if expected, err = w.expectsDequeue(queue, len(localPending)); err != nil {
+				return err
+			}
+		}
+	}
+	slices.Sort(pending)
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if !expected || !slices.Equal(pending, w.lastPending) {
+		w.lastProgress = time.Now()
+	}
+	w.lastPending = pending
+	return nil
+}
+
+// expectsDequeue reports whether this executor should be dequeuing workflows from the queue
+func (w *progressWatchdog) expectsDequeue(queue dbos.WorkflowQueue, localPending int) (bool, error) {
+	if queue.WorkerConcurrency != nil && localPending >= *queue.WorkerConcurrency {
+		return false, nil
+	}
+	enqueued, err := dbos.ListWorkflows(w.dbosContext,
+		dbos.WithQueueName(queue.Name),
+		dbos.WithStatus([]dbos.WorkflowStatusType{dbos.WorkflowStatusEnqueued}),
+		// Workflows of other versions are left to the executors running them
+		dbos.WithAppVersion(w.dbosContext.GetApplicationVersion()),
+		dbos.WithLimit(1),
+		dbos.WithLoadInput(false),
+		dbos.WithLoadOutput(false),
+	)
+	if err != nil || len(enqueued) == 0 {
+		return false, err
+	}
+	if queue.GlobalConcurrency == nil {
+		return true, nil
+	}
+	running, err := dbos.ListWorkflows(w.dbosContext,
+		dbos.WithQueueName(queue.Name),
+		dbos.WithStatus([]dbos.WorkflowStatusType{dbos.WorkflowStatusPending}),
+		dbos.WithLimit(*queue.GlobalConcurrency),
+		dbos.WithLoadInput(false),
+		dbos.WithLoadOutput(false),
+	)
+	if err != nil {
+		return false, err
+	}
+	return len(running) < *queue.GlobalConcurrency, nil
+}
+
+// stalledFor returns how long the executor has made no progress, or 0 if it is not stalled
+func (w *progressWatchdog) stalledFor() time.Duration {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if since := time.Since(w.lastProgress); since > w.stallTimeout {
+		return since
+	}
+	return 0
+}
@@ -2,101 +2,782 @@ package main
 
 import (
 	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"log/slog"
+	"net"
 	"net/http"
 	"os"
+	"os/signal"
+	"slices"
+	"sort"
 	"strconv"
+	"sync/atomic"
+	"syscall"
 	"time"
 
 	"github.com/dbos-inc/dbos-transact-golang/dbos"
 	"github.com/gin-gonic/gin"
+	"go.opentelemetry.io/otel/codes"
+
+	"kubernetes-integration/internal/autoscale"
 )
 
-// SleepWorkflowInput defines the input for the sleep workflow
-type SleepWorkflowInput struct {
-	DurationSeconds int `json:"duration_seconds"`
+// appName identifies the application to DBOS and in traces
+const appName = "dbos-starter"
+
+// InfoResponse describes the running instance, as returned by /info
+type InfoResponse struct {
+	AppName           string   `json:"app_name"`
+	Version           string   `json:"version"` // DBOS application version, APP_VERSION when set
+	AdminPort         int      `json:"admin_port"`
+	Queues            []string `json:"queues"`
+	UptimeSeconds     int64    `json:"uptime_seconds"`
+	EnqueueAvgSeconds float64  `json:"enqueue_avg_seconds"`        // Mean duration of the most recent enqueues
+	SchedulerLeader   *bool    `json:"scheduler_leader,omitempty"` // Whether this pod runs the scheduled workflows, with ENABLE_SCHEDULER
+}
+
+// IndexResponse lists the endpoints of the application, as returned by /
+type IndexResponse struct {
+	AppName   string   `json:"app_name"`
+	Endpoints []string `json:"endpoints"` // "METHOD /path", sorted by path
 }
 
-// MetricsResponse represents the response from the /metrics endpoint
+// MetricsResponse represents the response from the /metrics/:queueName endpoint
 type MetricsResponse struct {
 	QueueLength int `json:"queue_length"`
 }
 
-// WorkflowQueueMetadata represents the queue metadata from the admin endpoint
-type WorkflowQueueMetadata struct {
-	WorkerConcurrency int `json:"worker_concurrency"`
+// QueueSummary represents a queue in the response from the /queues endpoint
+type QueueSummary struct {
+	Name string `json:"name"`
+	autoscale.QueueMetric
 }
 
-// SleepWorkflow sleeps for the configured duration
-func SleepWorkflow(ctx dbos.DBOSContext, input SleepWorkflowInput) (string, error) {
-	duration := time.Duration(input.DurationSeconds) * time.Second
-	dbos.Sleep(ctx, duration)
-	return fmt.Sprintf("Slept for %d seconds", input.DurationSeconds), nil
+// QueueMetricsResponse represents the response from the /metrics endpoint
+type QueueMetricsResponse struct {
+	ExpectedPods int                              `json:"expected_pods"`
+	Capped       bool                             `json:"capped"`          // Whether expected_pods was clamped to the MAX_PODS ceiling
+	Stale        bool                             `json:"stale,omitempty"` // Whether the metrics are the last known ones, the current ones failing
+	Queues       map[string]autoscale.QueueMetric `json:"queues"`
+	Explain      *autoscale.Explanation           `json:"explain,omitempty"` // Set with ?explain=1
 }
 
-func main() {
-	dbosContext, err := dbos.NewDBOSContext(context.Background(), dbos.Config{
-		AppName:     "dbos-starter",
-		DatabaseURL: os.Getenv("DBOS_SYSTEM_DATABASE_URL"),
-	})
+// WorkflowStatusResponse represents the status of a single workflow as returned by the /workflow endpoints
+type WorkflowStatusResponse struct {
+	WorkflowID string          `json:"workflow_id"`
+	Status     string          `json:"status"`     // One of the workflowStatusNames values, or TIMED_OUT
+	RawStatus  string          `json:"raw_status"` // DBOS status, which may change across DBOS versions
+	QueueName  string          `json:"queue_name,omitempty"`
+	CreatedAt  time.Time       `json:"created_at"`
+	UpdatedAt  time.Time       `json:"updated_at"`
+	Deadline   *time.Time      `json:"deadline,omitempty"` // Set once a workflow enqueued with a timeout starts
+	Result     json.RawMessage `json:"result,omitempty"`
+	Error      string          `json:"error,omitempty"`
+}
+
+// Workflow statuses reported by the API, which stay stable whatever DBOS names them
+const (
+	workflowStatusQueued    = "QUEUED"
+	workflowStatusRunning   = "RUNNING"
+	workflowStatusSucceeded = "SUCCEEDED"
+	workflowStatusFailed    = "FAILED"
+	workflowStatusCancelled = "CANCELLED"
+	workflowStatusUnknown   = "UNKNOWN" // A DBOS status this version does not know, see raw_status
+	// workflowStatusTimedOut is reported instead of CANCELLED for the workflows DBOS cancelled at their deadline
+	workflowStatusTimedOut = "TIMED_OUT"
+)
+
+// workflowStatusNames maps the DBOS statuses to those reported by the API
+var workflowStatusNames = map[dbos.WorkflowStatusType]string{
+	dbos.WorkflowStatusEnqueued:                    workflowStatusQueued,
+	dbos.WorkflowStatusPending:                     workflowStatusRunning,
+	dbos.WorkflowStatusSuccess:                     workflowStatusSucceeded,
+	dbos.WorkflowStatusError:                       workflowStatusFailed,
+	dbos.WorkflowStatusMaxRecoveryAttemptsExceeded: workflowStatusFailed,
+	dbos.WorkflowStatusCancelled:                   workflowStatusCancelled,
+}
+
+// workflowStatusFilter returns the DBOS statuses selected by a status of the /workflows filter,
+// either a DBOS status or one reported by the API. It returns false when the status is unknown.
+func workflowStatusFilter(status string) ([]dbos.WorkflowStatusType, bool) {
+	if slices.Contains(workflowStatuses, dbos.WorkflowStatusType(status)) {
+		return []dbos.WorkflowStatusType{dbos.WorkflowStatusType(status)}, true
+	}
+	var statuses []dbos.WorkflowStatusType
+	for _, dbosStatus := range workflowStatuses {
+		if workflowStatusNames[dbosStatus] == status {
+			statuses = append(statuses, dbosStatus)
+		}
+	}
+	return statuses, statuses != nil
+}
+
+// newWorkflowStatusResponse converts a DBOS workflow status into its API representation
+func newWorkflowStatusResponse(status dbos.WorkflowStatus) WorkflowStatusResponse {
+	response := WorkflowStatusResponse{
+		WorkflowID: status.ID,
+		Status:     workflowStatusUnknown,
+		RawStatus:  string(status.Status),
+		QueueName:  status.QueueName,
+		CreatedAt:  status.CreatedAt,
+		UpdatedAt:  status.UpdatedAt,
+	}
+	if name, ok := workflowStatusNames[status.Status]; ok {
+		response.Status = name
+	}
+	if !status.Deadline.IsZero() {
+		response.Deadline = &status.Deadline
+		if status.Status == dbos.WorkflowStatusCancelled && !status.UpdatedAt.Before(status.Deadline) {
+			response.Status = workflowStatusTimedOut
+		}
+	}
+	// The output is loaded as its JSON encoding
+	if output, ok := status.Output.(string); ok && status.Status == dbos.WorkflowStatusSuccess && json.Valid([]byte(output)) {
+		response.Result = json.RawMessage(output)
+	}
+	if status.Error != nil {
+		response.Error = status.Error.Error()
+	}
+	return response
+}
+
+// workflowStatusDetails returns the status of a workflow, under the name reported by the API, and its DBOS
+// status as raw_status, for the responses that do not return a whole WorkflowStatusResponse
+func workflowStatusDetails(status dbos.WorkflowStatus) gin.H {
+	response := newWorkflowStatusResponse(status)
+	return gin.H{"status": response.Status, "raw_status": response.RawStatus}
+}
+
+// getWorkflowStatus returns the status of the given workflow, or nil if it does not exist
+func getWorkflowStatus(ctx dbos.DBOSContext, workflowID string) (*dbos.WorkflowStatus, error) {
+	workflows, err := dbos.ListWorkflows(ctx, dbos.WithWorkflowIDs([]string{workflowID}), dbos.WithLoadInput(false))
 	if err != nil {
-		panic(fmt.Sprintf("Initializing DBOS failed: %v", err))
+		return nil, err
+	}
+	if len(workflows) == 0 {
+		return nil, nil
 	}
+	return &workflows[0], nil
+}
 
-	// Create queue with worker concurrency = 10
-	queue := dbos.NewWorkflowQueue(dbosContext, "queueName", dbos.WithWorkerConcurrency(2))
+// isTerminalStatus reports whether a workflow with the given status will not run anymore
+func isTerminalStatus(status dbos.WorkflowStatusType) bool {
+	switch status {
+	case dbos.WorkflowStatusEnqueued, dbos.WorkflowStatusPending:
+		return false
+	default:
+		return true
+	}
+}
 
-	// Register the sleep workflow
-	dbos.RegisterWorkflow(dbosContext, SleepWorkflow)
+// readinessState tracks the dependencies checked by the /readyz probe
+type readinessState struct {
+	dbosLaunched      atomic.Bool
+	databaseReachable atomic.Bool
+	shuttingDown      atomic.Bool
+}
+
+var readiness readinessState
+
+// startTime is set once at the start of main, before any goroutine reads it
+var startTime time.Time
+
+// uptime returns the time elapsed since the process started
+func uptime() time.Duration {
+	return time.Since(startTime)
+}
 
-	err = dbos.Launch(dbosContext)
+// dbosWorkflowLister lists the queued workflows from the DBOS system database,
+// recording whether the database was reachable for the readiness probe
+type dbosWorkflowLister struct {
+	dbosContext dbos.DBOSContext
+	appVersion  string // Only count the workflows of this application version, if set
+}
+
+func (l dbosWorkflowLister) ListQueuedWorkflows(ctx context.Context, offset, limit int) ([]dbos.WorkflowStatus, error) {
+	_, span := tracer.Start(ctx, "dbos.ListWorkflows")
+	defer span.End()
+
+	opts := []dbos.ListWorkflowsOption{
+		dbos.WithQueuesOnly(),
+		dbos.WithOffset(offset),
+		dbos.WithLimit(limit),
+		dbos.WithLoadInput(false),
+		dbos.WithLoadOutput(false),
+	}
+	if l.appVersion != "" {
+		opts = append(opts, dbos.WithAppVersion(l.appVersion))
+	}
+	workflows, err := dbos.ListWorkflows(l.dbosContext, opts...)
+	readiness.databaseReachable.Store(err == nil)
 	if err != nil {
-		panic(fmt.Sprintf("Launching DBOS failed: %v", err))
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	return workflows, err
+}
+
+// sortedQueueNames returns the names of the queues in the metrics, in alphabetical order
+func sortedQueueNames(metrics map[string]autoscale.QueueMetric) []string {
+	queueNames := make([]string, 0, len(metrics))
+	for name := range metrics {
+		queueNames = append(queueNames, name)
 	}
-	defer dbos.Shutdown(dbosContext, 5*time.Second)
+	sort.Strings(queueNames)
+	return queueNames
+}
 
-	r := gin.Default()
+// Bounds on how long /workflow/:id/result waits for a workflow to complete
+const (
+	defaultResultTimeout = 30 * time.Second
+	maxResultTimeout     = 5 * time.Minute
+)
+
+// Page size bounds of the /workflows endpoint
+const (
+	defaultListLimit = 50
+	maxListLimit     = 500
+)
 
-	// Metrics endpoint for KEDA autoscaling - accepts queue name as URL parameter
-	r.GET("/metrics/:queueName", func(c *gin.Context) {
-		queueName := c.Param("queueName")
-		workflows, err := dbos.ListWorkflows(dbosContext, dbos.WithQueuesOnly(), dbos.WithQueueName(queueName))
+// workflowStatuses lists the DBOS statuses accepted by the /workflows status filter
+var workflowStatuses = []dbos.WorkflowStatusType{
+	dbos.WorkflowStatusPending,
+	dbos.WorkflowStatusEnqueued,
+	dbos.WorkflowStatusSuccess,
+	dbos.WorkflowStatusError,
+	dbos.WorkflowStatusCancelled,
+	dbos.WorkflowStatusMaxRecoveryAttemptsExceeded,
+}
+
+// maxBatchSize caps the number of workflows enqueued by a single /enqueue/batch request
+const maxBatchSize = 1000
+
+// EnqueueRequest represents the body of the POST /enqueue endpoint
+type EnqueueRequest struct {
+	DurationSeconds *int   `json:"duration_seconds"` // Required
+	Queue           string `json:"queue"`            // Defaults to the first configured queue
+	IdempotencyKey  string `json:"idempotency_key"`  // Takes precedence over the Idempotency-Key header
+	DeduplicationID string `json:"dedup_id"`         // Takes precedence over the dedup_id query parameter
+	Priority        *int   `json:"priority"`         // Takes precedence over the priority query parameter
+	TimeoutSeconds  *int   `json:"timeout_seconds"`  // Takes precedence over the timeout_seconds query parameter
+	CallbackURL     string `json:"callback_url"`     // Takes precedence over the callback_url query parameter
+}
+
+// BatchEnqueueRequest represents the body of the /enqueue/batch endpoint
+type BatchEnqueueRequest struct {
+	Durations []int `json:"durations"`
+}
+
+// ConcurrencyOverrideRequest represents the body of the POST /queues/:name/concurrency endpoint
+type ConcurrencyOverrideRequest struct {
+	Value *int `json:"value"` // Required, the worker concurrency used in the pod computation
+}
+
+// RecoverRequest represents the body of the POST /workflows/recover endpoint
+type RecoverRequest struct {
+	ExecutorIDs []string `json:"executor_ids"` // Required, the executors whose pending workflows this pod takes over
+}
+
+// selectQueue returns the queue named by the "queue" query parameter, defaulting to the first configured one.
+// It responds with 400 and returns false when the queue is unknown.
+func selectQueue(c *gin.Context, queues []dbos.WorkflowQueue) (dbos.WorkflowQueue, bool) {
+	return findQueue(c, queues, c.Query("queue"))
+}
+
+// findQueue returns the named queue, defaulting to the first configured one when the name is empty.
+// It responds with 400 and returns false when the queue is unknown.
+func findQueue(c *gin.Context, queues []dbos.WorkflowQueue, queueName string) (dbos.WorkflowQueue, bool) {
+	if queueName == "" {
+		return queues[0], true
+	}
+	validQueues := make([]string, 0, len(queues))
+	for _, queue := range queues {
+		if queue.Name == queueName {
+			return queue, true
+		}
+		validQueues = append(validQueues, queue.Name)
+	}
+	respondErrorWithDetails(c, http.StatusBadRequest, ErrCodeQueueNotFound, fmt.Sprintf("Unknown queue: %s", queueName), gin.H{"valid_queues": validQueues})
+	return dbos.WorkflowQueue{}, false
+}
+
+// errIdempotencyConflict is returned when an idempotency key is reused with a different workflow input
+var errIdempotencyConflict = errors.New("idempotency key already used with a different input")
+
+// idempotencyKey returns the key supplied with the Idempotency-Key header or the idempotency_key query parameter
+func idempotencyKey(c *gin.Context) string {
+	if key := c.GetHeader("Idempotency-Key"); key != "" {
+		return key
+	}
+	return c.Query("idempotency_key")
+}
+
+// findIdempotentWorkflow reports whether a workflow was already enqueued under the given idempotency key,
+// which doubles as its workflow ID. It returns errIdempotencyConflict if that workflow has a different input or queue.
+func findIdempotentWorkflow(ctx dbos.DBOSContext, key string, queueName string, input any) (bool, error) {
+	workflows, err := dbos.ListWorkflows(ctx, dbos.WithWorkflowIDs([]string{key}), dbos.WithLoadOutput(false))
+	if err != nil {
+		return false, err
+	}
+	if len(workflows) == 0 {
+		return false, nil
+	}
+	if workflows[0].QueueName != queueName {
+		return true, errIdempotencyConflict
+	}
+	// The input is loaded as its JSON encoding
+	encodedInput, err := json.Marshal(input)
+	if err != nil {
+		return false, err
+	}
+	if recorded, ok := workflows[0].Input.(string); !ok || recorded != string(encodedInput) {
+		return true, errIdempotencyConflict
+	}
+	return true, nil
+}
+
+// enqueueOptions holds the optional settings of an enqueue request
+type enqueueOptions struct {
+	idempotencyKey  string // Used as the workflow ID, so that retries return the workflow already enqueued
+	deduplicationID string // Rejects the workflow while another one with the same ID is enqueued or running
+	priority        *int   // Dequeue priority, lower values first, on queues with priorities enabled
+	timeoutSeconds  *int   // Cancels the workflow if it has not completed this long after it started
+	callbackURL     string // Notified by the workflow once it completes, see notifyCallback
+	dryRun          bool   // Validates the request and describes the workflow without enqueuing it
+}
+
+// enqueueOptionsFromQuery reads the enqueue options from the query parameters and headers.
+// It responds with 400 and returns false when they are invalid.
+func enqueueOptionsFromQuery(c *gin.Context) (enqueueOptions, bool) {
+	options := enqueueOptions{
+		idempotencyKey:  idempotencyKey(c),
+		deduplicationID: c.Query("dedup_id"),
+		callbackURL:     c.Query("callback_url"),
+		dryRun:          c.Query("validate") == "1",
+	}
+	if value := c.Query("priority"); value != "" {
+		priority, err := strconv.Atoi(value)
 		if err != nil {
-			c.JSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("Error computing metrics: %v", err)})
-			return
+			respondError(c, http.StatusBadRequest, ErrCodeInvalidParameter, fmt.Sprintf("Invalid priority %q: must be a non-negative integer", value))
+			return enqueueOptions{}, false
+		}
+		options.priority = &priority
+	}
+	if value := c.Query("timeout_seconds"); value != "" {
+		timeout, err := strconv.Atoi(value)
+		if err != nil {
+			respondError(c, http.StatusBadRequest, ErrCodeInvalidParameter, fmt.Sprintf("Invalid timeout_seconds %q: must be a positive integer", value))
+			return enqueueOptions{}, false
 		}
+		options.timeoutSeconds = &timeout
+	}
+	return options, true
+}
 
-		c.JSON(http.StatusOK, MetricsResponse{QueueLength: len(workflows)})
-	})
+// withWorkflowTimeout returns a context enqueuing workflows with the given timeout. DBOS starts the
+// timeout when the workflow is dequeued and cancels the workflow once it expires. Other DBOS calls made
+// with the context stop once it expires. Contexts that are not DBOS contexts, such as test fakes, cannot
+// carry a timeout and are returned unchanged.
+func withWorkflowTimeout(ctx dbos.DBOSContext, timeout time.Duration) (dbos.DBOSContext, context.CancelFunc) {
+	timeoutCtx, cancel := dbos.WithTimeout(ctx, timeout)
+	if timeoutCtx == nil {
+		return ctx, cancel
+	}
+	return timeoutCtx, cancel
+}
+
+// enqueueContext returns the request context, bounded by timeout when it is positive
+func enqueueContext(c *gin.Context, timeout time.Duration) (context.Context, context.CancelFunc) {
+	if timeout <= 0 {
+		return context.WithCancel(c.Request.Context())
+	}
+	return context.WithTimeout(c.Request.Context(), timeout)
+}
+
+// enqueueWithin runs enqueue, giving up with the context's error once ctx is done. RunWorkflow does not
+// stop its database calls when its context is done, so an enqueue given up on may still complete later.
+func enqueueWithin[T any](ctx context.Context, enqueue func() (T, error)) (T, error) {
+	type result struct {
+		value T
+		err   error
+	}
+	done := make(chan result, 1)
+	go func() {
+		value, err := enqueue()
+		done <- result{value, err}
+	}()
+	select {
+	case r := <-done:
+		return r.value, r.err
+	case <-ctx.Done():
+		var zero T
+		return zero, ctx.Err()
+	}
+}
+
+// statusClientClosedRequest is the non-standard status, from nginx, logged for the requests
+// whose client disconnected before the response
+const statusClientClosedRequest = 499
 
-	// Handler to enqueue a workflow with configurable sleep duration
-	r.GET("/enqueue/:duration", func(c *gin.Context) {
-		// Get duration from URL path parameter
-		durationStr := c.Param("duration")
-		duration, err := strconv.Atoi(durationStr)
+// respondEnqueueInterrupted handles an enqueue given up by enqueueWithin, returning whether it was.
+// It answers 504 when timeout expired, and only logs and aborts when the client disconnected, there
+// being no one to answer. details are added to the 504, if set.
+func respondEnqueueInterrupted(c *gin.Context, err error, timeout time.Duration, details gin.H) bool {
+	switch {
+	case errors.Is(err, context.DeadlineExceeded):
+		message := fmt.Sprintf("Enqueuing the workflow did not complete within %s: it may still be enqueued, retry with an Idempotency-Key to avoid duplicates", timeout)
+		if details == nil {
+			respondError(c, http.StatusGatewayTimeout, ErrCodeEnqueueTimeout, message)
+		} else {
+			respondErrorWithDetails(c, http.StatusGatewayTimeout, ErrCodeEnqueueTimeout, message, details)
+		}
+		return true
+	case errors.Is(err, context.Canceled):
+		slog.Warn("Client disconnected before the workflow was enqueued, it may still be", "request_id", requestID(c), "path", c.FullPath())
+		c.AbortWithStatus(statusClientClosedRequest)
+		return true
+	}
+	return false
+}
+
+// addStartEstimate adds to the enqueue response the best-effort estimate of when the workflow starts, if
+// there is one within timeout: the workflow being enqueued already, the response does not wait for longer
+func addStartEstimate(c *gin.Context, response gin.H, estimator *startEstimator, queueName string, timeout time.Duration) {
+	ctx, cancel := enqueueContext(c, timeout)
+	defer cancel()
+	if seconds := estimator.estimate(ctx, queueName); seconds != nil {
+		response["estimated_start_in_seconds"] = *seconds
+	}
+}
+
+// enqueueSleepWorkflow enqueues a sleep workflow on the given queue and writes the response
+func enqueueSleepWorkflow(c *gin.Context, ctx dbos.DBOSContext, estimator *startEstimator, queue dbos.WorkflowQueue, input SleepWorkflowInput, options enqueueOptions, timeout time.Duration) {
+	opts := []dbos.WorkflowOption{dbos.WithQueue(queue.Name)}
+	if options.priority != nil {
+		if *options.priority < 0 || !queue.PriorityEnabled {
+			respondError(c, http.StatusBadRequest, ErrCodeInvalidParameter, fmt.Sprintf("Invalid priority %d: must be a non-negative integer, on a queue with priorities enabled", *options.priority))
+			return
+		}
+		opts = append(opts, dbos.WithPriority(uint(*options.priority)))
+	}
+	if options.deduplicationID != "" {
+		opts = append(opts, dbos.WithDeduplicationID(options.deduplicationID))
+	}
+	if options.timeoutSeconds != nil {
+		if *options.timeoutSeconds <= 0 {
+			respondError(c, http.StatusBadRequest, ErrCodeInvalidParameter, fmt.Sprintf("Invalid timeout_seconds %d: must be a positive integer", *options.timeoutSeconds))
+			return
+		}
+		var cancel context.CancelFunc
+		ctx, cancel = withWorkflowTimeout(ctx, time.Duration(*options.timeoutSeconds)*time.Second)
+		defer cancel()
+	}
+	if options.callbackURL != "" {
+		if err := validateOutboundURL(c.Request.Context(), "callback_url", options.callbackURL); err != nil {
+			respondError(c, http.StatusBadRequest, ErrCodeInvalidParameter, fmt.Sprintf("Invalid callback_url: %v", err))
+			return
+		}
+		input.CallbackURL = options.callbackURL
+	}
+	input.RequestID = requestID(c)
+	key := options.idempotencyKey
+	deduplicated := false
+	if key != "" {
+		var err error
+		deduplicated, err = findIdempotentWorkflow(ctx, key, queue.Name, input)
+		if errors.Is(err, errIdempotencyConflict) {
+			respondError(c, http.StatusConflict, ErrCodeIdempotencyConflict, fmt.Sprintf("Idempotency key %s was already used with a different input or queue", key))
+			return
+		}
 		if err != nil {
-			c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("Invalid duration: %v", err)})
+			respondError(c, http.StatusInternalServerError, ErrCodeDatabaseError, fmt.Sprintf("Error checking idempotency key: %v", err))
 			return
 		}
+		opts = append(opts, dbos.WithWorkflowID(key))
+	}
 
-		input := SleepWorkflowInput{
-			DurationSeconds: duration,
+	if options.dryRun {
+		response := gin.H{
+			"message":      "Workflow valid, not enqueued",
+			"dry_run":      true,
+			"queue":        queue.Name,
+			"deduplicated": deduplicated,
+		}
+		if input.DurationMillis > 0 {
+			response["duration_millis"] = input.DurationMillis
+		} else {
+			response["duration"] = input.DurationSeconds
+		}
+		if key != "" {
+			response["idempotency_key"] = key
+		}
+		if options.deduplicationID != "" {
+			response["dedup_id"] = options.deduplicationID
 		}
+		if options.priority != nil {
+			response["priority"] = *options.priority
+		}
+		if options.timeoutSeconds != nil {
+			response["timeout_seconds"] = *options.timeoutSeconds
+		}
+		if options.callbackURL != "" {
+			response["callback_url"] = options.callbackURL
+		}
+		c.JSON(http.StatusOK, response)
+		return
+	}
 
-		handle, err := dbos.RunWorkflow(dbosContext, SleepWorkflow, input, dbos.WithQueue(queue.Name))
+	workflowID := key
+	if !deduplicated {
+		requestCtx, cancel := enqueueContext(c, timeout)
+		defer cancel()
+		start := time.Now()
+		handle, err := enqueueWithin(requestCtx, func() (dbos.WorkflowHandle[string], error) {
+			return dbos.RunWorkflow(ctx, SleepWorkflow, input, opts...)
+		})
+		enqueueLatency.observe(start, queue.Name, err)
+		if respondEnqueueInterrupted(c, err, timeout, nil) {
+			return
+		}
+		if errors.Is(err, &dbos.DBOSError{Code: dbos.QueueDeduplicated}) {
+			respondError(c, http.StatusConflict, ErrCodeDuplicateWorkflow, fmt.Sprintf("A workflow with deduplication ID %s is already enqueued on queue %s", options.deduplicationID, queue.Name))
+			return
+		}
+		if errors.Is(err, &dbos.DBOSError{Code: dbos.ConflictingWorkflowError}) {
+			respondError(c, http.StatusConflict, ErrCodeIdempotencyConflict, fmt.Sprintf("Idempotency key %s was already used with a different input: %v", key, err))
+			return
+		}
 		if err != nil {
-			c.JSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("Error enqueuing workflow: %v", err)})
+			respondError(c, http.StatusInternalServerError, ErrCodeEnqueueFailed, fmt.Sprintf("Error enqueuing workflow: %v", err))
 			return
 		}
+		workflowID = handle.GetWorkflowID()
+		logEnqueued(c, workflowID, queue.Name)
+	}
 
-		workflowID := handle.GetWorkflowID()
+	response := gin.H{
+		"message":      "Workflow enqueued successfully",
+		"workflow_id":  workflowID,
+		"queue":        queue.Name,
+		"deduplicated": deduplicated,
+	}
+	if input.DurationMillis > 0 {
+		response["duration_millis"] = input.DurationMillis
+	} else {
+		response["duration"] = input.DurationSeconds
+	}
+	addStartEstimate(c, response, estimator, queue.Name, timeout)
+	c.JSON(http.StatusOK, response)
+}
 
-		c.JSON(http.StatusOK, gin.H{
-			"message":     "Workflow enqueued successfully",
-			"workflow_id": workflowID,
-			"duration":    input.DurationSeconds,
-		})
+func main() {
+	command, args := commandFromArgs(os.Args[1:])
+	os.Exit(runCommand(command, args))
+}
+
+// setupDBOS creates the DBOS context, its queues and workflows from the configuration, and launches it
+// when launch is set. Only a launched context serves the admin server and runs the enqueued workflows;
+// one left unlaunched acts as a client of the system database, to enqueue and inspect workflows.
+func setupDBOS(config AppConfig, launch bool) (dbos.DBOSContext, []dbos.WorkflowQueue, error) {
+	dbosContext, err := dbos.NewDBOSContext(context.Background(), dbos.Config{
+		AppName:            appName,
+		DatabaseURL:        config.DatabaseURL,
+		AdminServer:        launch,
+		AdminServerPort:    config.AdminPort,
+		Logger:             slog.Default(),
+		ApplicationVersion: config.AppVersion,
 	})
+	if err != nil {
+		return nil, nil, fmt.Errorf("initializing DBOS: %w", err)
+	}
 
-	r.Run(":8000")
+	// Create the configured queues
+	queues := make([]dbos.WorkflowQueue, 0, len(config.Queues))
+	for _, queueConfig := range config.Queues {
+		var opts []dbos.QueueOption
+		if queueConfig.WorkerConcurrency > 0 {
+			opts = append(opts, dbos.WithWorkerConcurrency(queueConfig.WorkerConcurrency))
+		}
+		if queueConfig.GlobalConcurrency > 0 {
+			opts = append(opts, dbos.WithGlobalConcurrency(queueConfig.GlobalConcurrency))
+		}
+		if queueConfig.PriorityEnabled {
+			opts = append(opts, dbos.WithPriorityEnabled())
+		}
+		queues = append(queues, dbos.NewWorkflowQueue(dbosContext, queueConfig.Name, opts...))
+	}
+
+	// Register the workflows, FetchWorkflow and the callbacks reaching the internal networks of OUTBOUND_ALLOWED_NETWORKS only
+	outboundAllowed = config.outboundNetworks()
+	dbos.RegisterWorkflow(dbosContext, SleepWorkflow)
+	dbos.RegisterWorkflow(dbosContext, FibonacciWorkflow)
+	dbos.RegisterWorkflow(dbosContext, MultiStepWorkflow)
+	dbos.RegisterWorkflow(dbosContext, FetchWorkflow)
+	if !launch {
+		return dbosContext, queues, nil
+	}
+	if config.EnableScheduler {
+		// Run by startScheduler on the leader only
+		dbos.RegisterWorkflow(dbosContext, QueueDepthReportWorkflow)
+	}
+
+	if err := dbos.Launch(dbosContext); err != nil {
+		return nil, nil, fmt.Errorf("launching DBOS: %w", err)
+	}
+	return dbosContext, queues, nil
+}
+
+// newMetadataSource returns the source of the queue metadata: the DBOS admin server, or the
+// MOCK_ADMIN_FILE fixture when it is set
+func newMetadataSource(config AppConfig) (*autoscale.AdminMetadataSource, error) {
+	metadataURL := config.adminURL("/dbos-workflow-queues-metadata")
+	if config.MockAdminFile != "" {
+		var err error
+		if metadataURL, err = startMockAdmin(config.MockAdminFile); err != nil {
+			return nil, fmt.Errorf("starting the mock admin server: %w", err)
+		}
+	}
+	return autoscale.NewAdminMetadataSource(autoscale.AdminConfig{
+		URL:            metadataURL,
+		Timeout:        config.AdminTimeout,
+		RetryAttempts:  config.AdminRetryAttempts,
+		RetryBaseDelay: config.AdminRetryBaseDelay,
+		CacheTTL:       config.MetadataCacheTTL,
+	}), nil
+}
+
+// runServer runs the HTTP server until SIGTERM or SIGINT and returns the process exit code. With selfTest,
+// it runs the self-test instead of serving.
+func runServer(config AppConfig, selfTest bool) int {
+	startTime = time.Now()
+
+	shutdownTracing, err := setupTracing(context.Background())
+	if err != nil {
+		slog.Error("Setting up tracing failed", "error", err)
+		return 1
+	}
+	defer shutdownTracing(context.Background())
+
+	dbosContext, queues, err := setupDBOS(config, true)
+	if err != nil {
+		slog.Error("Starting DBOS failed", "error", err)
+		return 1
+	}
+	readiness.dbosLaunched.Store(true)
+	readiness.databaseReachable.Store(true)
+
+	if selfTest {
+		code := runSelfTest(dbosContext, queues[0])
+		dbos.Shutdown(dbosContext, config.ShutdownTimeout)
+		return code
+	}
+
+	systemDB, err := openSystemDB(context.Background(), config.DatabaseURL)
+	if err != nil {
+		slog.Error("Opening the system database failed", "error", err)
+		dbos.Shutdown(dbosContext, config.ShutdownTimeout)
+		return 1
+	}
+	defer systemDB.close()
+
+	// Serve until SIGTERM or SIGINT, then drain in-flight requests before shutting DBOS down.
+	// The signal also stops the background work.
+	signalCtx, stop := signal.NotifyContext(context.Background(), syscall.SIGTERM, syscall.SIGINT)
+	defer stop()
+
+	var leader *leaderElector
+	if config.EnableScheduler {
+		leader = newLeaderElector(systemDB.connConfig(), schedulerLockID)
+		go leader.run(signalCtx)
+		stopScheduler, err := startScheduler(dbosContext, config.SchedulerCron, leader)
+		if err != nil {
+			slog.Error("Starting the scheduler failed", "error", err)
+			dbos.Shutdown(dbosContext, config.ShutdownTimeout)
+			return 1
+		}
+		defer stopScheduler()
+	}
+
+	metadataSource, err := newMetadataSource(config)
+	if err != nil {
+		slog.Error("Creating the queue metadata source failed", "error", err)
+		dbos.Shutdown(dbosContext, config.ShutdownTimeout)
+		return 1
+	}
+	var watchdog *progressWatchdog
+	if config.LivenessTimeout > 0 {
+		watchdog = newProgressWatchdog(dbosContext, queues, config.LivenessInterval, config.LivenessTimeout)
+	}
+
+	// The ScaledObject is best-effort: the app serves without it, e.g. when RBAC denies it
+	if config.ManageScaledObject {
+		go func() {
+			err := registerScaledObject(signalCtx, config)
+			switch {
+			case errors.Is(err, errScaledObjectForbidden):
+				slog.Warn("Skipping the ScaledObject registration: RBAC denies it", "error", err)
+			case err != nil:
+				slog.Warn("Registering the KEDA ScaledObject failed", "error", err)
+			}
+		}()
+	}
+
+	// SIGHUP reloads CONFIG_FILE, the environment being fixed for the life of the process
+	reloader := newConfigReloader(config, loadConfig)
+	go reloader.run(signalCtx)
+
+	r := newRouter(routerDeps{
+		config:      config,
+		dbosContext: dbosContext,
+		queues:      queues,
+		metadata:    metadataSource,
+		watchdog:    watchdog,
+		background:  signalCtx,
+		purger:      systemDB,
+		recoverer:   newAdminRecoverer(config),
+		leader:      leader,
+		reloader:    reloader,
+	})
+
+	listener, err := net.Listen("tcp", fmt.Sprintf(":%d", config.Port))
+	if err != nil {
+		slog.Error("Failed to bind HTTP server", "port", config.Port, "error", err)
+		dbos.Shutdown(dbosContext, config.ShutdownTimeout)
+		return 1
+	}
+	slog.Info("HTTP server listening", "address", listener.Addr().String(), "tls", config.TLSCertFile != "")
+
+	if watchdog != nil {
+		go watchdog.run(signalCtx)
+	}
+
+	server := &http.Server{Handler: r}
+	serveErr := make(chan error, 1)
+	go func() {
+		if config.TLSCertFile != "" {
+			serveErr <- server.ServeTLS(listener, config.TLSCertFile, config.TLSKeyFile)
+		} else {
+			serveErr <- server.Serve(listener)
+		}
+	}()
+
+	select {
+	case err := <-serveErr:
+		slog.Error("HTTP server failed", "error", err)
+		dbos.Shutdown(dbosContext, config.ShutdownTimeout)
+		return 1
+	case <-signalCtx.Done():
+	}
+
+	slog.Info("Shutting down", "timeout", config.ShutdownTimeout)
+	readiness.shuttingDown.Store(true)
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), config.ShutdownTimeout)
+	defer cancel()
+	if err := server.Shutdown(shutdownCtx); err != nil {
+		slog.Error("HTTP server shutdown failed", "error", err)
+	}
+	dbos.Shutdown(dbosContext, config.ShutdownTimeout)
+	return 0
 }
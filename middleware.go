@@ -0,0 +1,285 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math"
+	"net/http"
+	"runtime/debug"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+)
+
+// requestIDHeader carries the request ID, either supplied by the client or generated
+const requestIDHeader = "X-Request-ID"
+
+// requestIDKey is the Gin context key under which the request ID is stored
+const requestIDKey = "request_id"
+
+// requestLogger assigns an ID to every request, returns it in the X-Request-ID header
+// and logs the request as structured JSON once it completes
+func requestLogger() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		start := time.Now()
+		id := c.GetHeader(requestIDHeader)
+		if id == "" {
+			id = uuid.NewString()
+		}
+		c.Set(requestIDKey, id)
+		c.Header(requestIDHeader, id)
+
+		c.Next()
+
+		slog.Info("HTTP request",
+			"request_id", id,
+			"method", c.Request.Method,
+			"path", c.Request.URL.Path,
+			"status", c.Writer.Status(),
+			"latency", time.Since(start).String(),
+			"client_ip", c.ClientIP(),
+		)
+	}
+}
+
+// requestID returns the ID assigned to the request by requestLogger
+func requestID(c *gin.Context) string {
+	return c.GetString(requestIDKey)
+}
+
+// recoverPanics turns a panicking handler into a 500 INTERNAL response, logging the panic and its stack.
+// The stack is only returned to the client when includeStack is set, for local development.
+func recoverPanics(includeStack bool) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		defer func() {
+			recovered := recover()
+			if recovered == nil {
+				return
+			}
+			if err, ok := recovered.(error); ok && errors.Is(err, http.ErrAbortHandler) {
+				// Let net/http abort the response, as the handler intended
+				panic(recovered)
+			}
+			stack := string(debug.Stack())
+			slog.Error("Handler panicked",
+				"request_id", requestID(c),
+				"method", c.Request.Method,
+				"path", c.Request.URL.Path,
+				"panic", fmt.Sprint(recovered),
+				"stack", stack,
+			)
+			if c.Writer.Written() {
+				// Part of the response is already sent, it cannot become an error response
+				c.Abort()
+				return
+			}
+			var details any
+			if includeStack {
+				details = gin.H{"panic": fmt.Sprint(recovered), "stack": stack}
+			}
+			respondErrorWithDetails(c, http.StatusInternalServerError, ErrCodeInternal, "Internal server error", details)
+		}()
+		c.Next()
+	}
+}
+
+// apiTokenAuth rejects with 401 the requests without an "Authorization: Bearer <token>" header
+// matching the token. It lets every request through when the token is empty.
+func apiTokenAuth(token string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if token == "" {
+			return
+		}
+		provided, ok := strings.CutPrefix(c.GetHeader("Authorization"), "Bearer ")
+		if !ok || subtle.ConstantTimeCompare([]byte(provided), []byte(token)) != 1 {
+			c.Header("WWW-Authenticate", `Bearer realm="dbos-starter"`)
+			respondError(c, http.StatusUnauthorized, ErrCodeUnauthorized, "Missing or invalid bearer token")
+		}
+	}
+}
+
+// rateLimit rejects with 429 the requests exceeding ENQUEUE_RATE_LIMIT per second, allowing bursts of up
+// to ENQUEUE_RATE_BURST requests. The limit is shared by every route the handler is installed on. It lets
+// every request through when the rate is 0.
+func rateLimit(live *liveConfig) gin.HandlerFunc {
+	bucket := &tokenBucket{}
+	return func(c *gin.Context) {
+		settings := live.load()
+		if settings.EnqueueRateLimit <= 0 {
+			return
+		}
+		if wait := bucket.take(time.Now(), settings.EnqueueRateLimit, float64(settings.EnqueueRateBurst)); wait > 0 {
+			c.Header("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+			respondError(c, http.StatusTooManyRequests, ErrCodeRateLimited, "Too many enqueue requests, retry later")
+		}
+	}
+}
+
+// tokenBucket holds up to burst tokens, refilled at rate tokens per second. It starts full.
+type tokenBucket struct {
+	mu     sync.Mutex
+	tokens float64
+	last   time.Time // When tokens was last refilled, zero before the first take
+}
+
+// take consumes a token, returning 0 on success or, when the bucket is empty, how long until a token is available
+func (b *tokenBucket) take(now time.Time, rate, burst float64) time.Duration {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.last.IsZero() {
+		b.tokens = burst
+	}
+	b.tokens = min(burst, b.tokens+now.Sub(b.last).Seconds()*rate)
+	b.last = now
+	if b.tokens >= 1 {
+		b.tokens--
+		return 0
+	}
+	return time.Duration((1 - b.tokens) / rate * float64(time.Second))
+}
+
+// limitConcurrency rejects with 503 the requests arriving while MAX_CONCURRENT_REQUESTS others are being
+// handled, so that storms of enqueues queue up in the clients rather than on the database connections.
+// The limit is shared by every route the handler is installed on. It lets every request through when
+// the limit is 0.
+func limitConcurrency(live *liveConfig) gin.HandlerFunc {
+	var inFlight atomic.Int64
+	return func(c *gin.Context) {
+		// The requests are counted even without a limit, for one set by a reload to apply to them
+		limit := live.load().MaxConcurrent
+		if n := inFlight.Add(1); limit > 0 && n > int64(limit) {
+			inFlight.Add(-1)
+			c.Header("Retry-After", "1")
+			respondError(c, http.StatusServiceUnavailable, ErrCodeOverloaded, fmt.Sprintf("Too many concurrent requests: at most %d handled at once, retry later", limit))
+			return
+		}
+		defer inFlight.Add(-1)
+		c.Next()
+	}
+}
+
+// limitBody rejects with 413 the requests whose body is larger than MAX_BODY_BYTES. Bodies of unknown
+// length are cut at the limit, which bindJSON reports as a 413 as well.
+func limitBody(live *liveConfig) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		maxBytes := int64(live.load().MaxBodyBytes)
+		if c.Request.ContentLength > maxBytes {
+			respondError(c, http.StatusRequestEntityTooLarge, ErrCodePayloadTooLarge, fmt.Sprintf("Request body too large: at most %d bytes allowed", maxBytes))
+			return
+		}
+		c.Request.Body = http.MaxBytesReader(c.Writer, c.Request.Body, maxBytes)
+	}
+}
+
+// encodeResponses indents the JSON responses of the requests with ?pretty=1, and gzips the responses
+// of at least gzipMinBytes for the clients accepting it, unless the handler already encoded them as
+// /prometheus does. The responses it changes are buffered until the handler returns.
+func encodeResponses(gzipMinBytes int) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		pretty, _ := strconv.ParseBool(c.Query("pretty"))
+		if gzipMinBytes > 0 {
+			c.Writer.Header().Add("Vary", "Accept-Encoding")
+		}
+		compress := gzipMinBytes > 0 && acceptsGzip(c.GetHeader("Accept-Encoding"))
+		if !pretty && !compress {
+			return
+		}
+
+		original := c.Writer
+		buffered := &bufferedWriter{ResponseWriter: original}
+		c.Writer = buffered
+		// On a panic the buffered response is dropped, for recoverPanics to write the error response
+		defer func() { c.Writer = original }()
+		c.Next()
+
+		body := buffered.body.Bytes()
+		header := original.Header()
+		if pretty && strings.HasPrefix(header.Get("Content-Type"), "application/json") {
+			var indented bytes.Buffer
+			if err := json.Indent(&indented, body, "", "  "); err == nil {
+				body = indented.Bytes()
+				header.Del("Content-Length")
+			}
+		}
+		if compress && len(body) >= gzipMinBytes && header.Get("Content-Encoding") == "" {
+			header.Set("Content-Encoding", "gzip")
+			header.Del("Content-Length")
+			gz := gzip.NewWriter(original)
+			gz.Write(body)
+			gz.Close()
+			return
+		}
+		if len(body) > 0 {
+			original.Write(body)
+		}
+	}
+}
+
+// acceptsGzip returns whether an Accept-Encoding header allows gzip
+func acceptsGzip(acceptEncoding string) bool {
+	for _, coding := range strings.Split(acceptEncoding, ",") {
+		name, params, _ := strings.Cut(coding, ";")
+		name = strings.TrimSpace(name)
+		if name != "gzip" && name != "*" {
+			continue
+		}
+		if q, ok := strings.CutPrefix(strings.TrimSpace(params), "q="); ok {
+			if weight, err := strconv.ParseFloat(q, 64); err == nil && weight == 0 {
+				return false
+			}
+		}
+		return true
+	}
+	return false
+}
+
+// bufferedWriter holds the body written by the handlers, for encodeResponses to encode it once complete
+type bufferedWriter struct {
+	gin.ResponseWriter
+	body bytes.Buffer
+}
+
+func (w *bufferedWriter) Write(data []byte) (int, error) {
+	return w.body.Write(data)
+}
+
+func (w *bufferedWriter) WriteString(s string) (int, error) {
+	return w.body.WriteString(s)
+}
+
+// WriteHeaderNow leaves the headers unsent, encodeResponses still having to set them
+func (w *bufferedWriter) WriteHeaderNow() {}
+
+func (w *bufferedWriter) Written() bool {
+	return w.body.Len() > 0 || w.ResponseWriter.Written()
+}
+
+func (w *bufferedWriter) Size() int {
+	return w.body.Len()
+}
+
+// bindJSON decodes the JSON request body into obj, responding with 413 when the body exceeds
+// the limitBody limit and with 400 when it is invalid. It returns whether decoding succeeded.
+func bindJSON(c *gin.Context, obj any) bool {
+	err := c.ShouldBindJSON(obj)
+	var tooLarge *http.MaxBytesError
+	switch {
+	case err == nil:
+		return true
+	case errors.As(err, &tooLarge):
+		respondError(c, http.StatusRequestEntityTooLarge, ErrCodePayloadTooLarge, fmt.Sprintf("Request body too large: at most %d bytes allowed", tooLarge.Limit))
+	default:
+		respondError(c, http.StatusBadRequest, ErrCodeInvalidBody, fmt.Sprintf("Invalid request body: %v", err))
+	}
+	return false
+}
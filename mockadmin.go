@@ -0,0 +1,71 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+
+	"kubernetes-integration/internal/autoscale"
+)
+
+// startMockAdmin serves the queue metadata fixture at path on a local port, standing in for the
+// /dbos-workflow-queues-metadata endpoint of the DBOS admin server, and returns the endpoint's URL.
+// The fixture is the JSON array the admin server returns, for example:
+//
+//	[
+//	  {"name": "queueName", "workerConcurrency": 2},
+//	  {"name": "bounded", "workerConcurrency": 1, "concurrency": 5},
+//	  {"name": "urgent", "workerConcurrency": 4, "priorityEnabled": true},
+//	  {"name": "counted", "workerConcurrency": 2, "enqueuedCount": 7, "runningCount": 2}
+//	]
+//
+// where "concurrency" is the global concurrency, omitted when the queue has no global limit.
+// "enqueuedCount" and "runningCount", which the DBOS admin server does not report, stand in for the
+// listed workflows when every queue has them and COUNT_SOURCE is not "list".
+// The file is read on every request, so edits apply once the metadata cache expires.
+func startMockAdmin(path string) (string, error) {
+	if _, err := readMockAdminFixture(path); err != nil {
+		return "", err
+	}
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return "", fmt.Errorf("starting mock admin server: %w", err)
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /dbos-workflow-queues-metadata", func(w http.ResponseWriter, r *http.Request) {
+		metadata, err := readMockAdminFixture(path)
+		if err != nil {
+			slog.Error("Serving mock queue metadata failed", "error", err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(metadata)
+	})
+	go func() {
+		if err := http.Serve(listener, mux); err != nil {
+			slog.Error("Mock admin server failed", "error", err)
+		}
+	}()
+
+	url := fmt.Sprintf("http://%s/dbos-workflow-queues-metadata", listener.Addr())
+	slog.Warn("Serving queue metadata from a fixture instead of the DBOS admin server", "file", path, "url", url)
+	return url, nil
+}
+
+// readMockAdminFixture reads and validates the queue metadata fixture
+func readMockAdminFixture(path string) ([]autoscale.QueueMetadata, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("reading MOCK_ADMIN_FILE: %w", err)
+	}
+	var metadata []autoscale.QueueMetadata
+	if err := json.Unmarshal(data, &metadata); err != nil {
+		return nil, fmt.Errorf("invalid MOCK_ADMIN_FILE %s: %w", path, err)
+	}
+	return metadata, nil
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"syscall"
+	"time"
+
+	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
+)
+
+// outboundMaxRedirects is the number of redirects an outbound client follows before failing
+const outboundMaxRedirects = 10
+
+// outboundAllowed are the internal networks the workflows requesting user-supplied URLs may reach anyway,
+// from OUTBOUND_ALLOWED_NETWORKS. It is set by setupDBOS, before any workflow runs.
+var outboundAllowed []netip.Prefix
+
+// checkOutboundAddr rejects the loopback, private, link-local and unspecified addresses outside of
+// outboundAllowed, so that a user-supplied URL cannot reach the pod, the cluster or the cloud metadata
+func checkOutboundAddr(addr netip.Addr) error {
+	addr = addr.Unmap()
+	if !addr.IsLoopback() && !addr.IsPrivate() && !addr.IsLinkLocalUnicast() && !addr.IsLinkLocalMulticast() && !addr.IsUnspecified() {
+		return nil
+	}
+	for _, prefix := range outboundAllowed {
+		if prefix.Contains(addr) {
+			return nil
+		}
+	}
+	return fmt.Errorf("%s is an internal address, which OUTBOUND_ALLOWED_NETWORKS does not allow", addr)
+}
+
+// checkOutboundHost resolves host and checks each of its addresses with checkOutboundAddr
+func checkOutboundHost(ctx context.Context, host string) error {
+	if addr, err := netip.ParseAddr(host); err == nil {
+		return checkOutboundAddr(addr)
+	}
+	addrs, err := net.DefaultResolver.LookupNetIP(ctx, "ip", host)
+	if err != nil {
+		return fmt.Errorf("resolving %s: %w", host, err)
+	}
+	for _, addr := range addrs {
+		if err := checkOutboundAddr(addr); err != nil {
+			return fmt.Errorf("%s resolves to %w", host, err)
+		}
+	}
+	return nil
+}
+
+// validateOutboundURL checks that the value of the named field is an absolute http or https URL whose
+// host resolves to addresses allowed by checkOutboundAddr
+func validateOutboundURL(ctx context.Context, name, value string) error {
+	if err := validateHTTPURL(name, value); err != nil {
+		return err
+	}
+	u, _ := url.Parse(value)
+	if err := checkOutboundHost(ctx, u.Hostname()); err != nil {
+		return fmt.Errorf("%s %q is not allowed: %w", name, value, err)
+	}
+	return nil
+}
+
+// newOutboundClient returns a client for user-supplied URLs, recording a client span per request. The
+// addresses are checked when dialing, so that a host resolving to another address since its validation
+// is rejected too, and the redirects before they are followed. Proxies are not used, since the checked
+// address would then be that of the proxy.
+func newOutboundClient(timeout time.Duration) *http.Client {
+	dialer := &net.Dialer{
+		Timeout:   30 * time.Second,
+		KeepAlive: 30 * time.Second,
+		Control: func(_, address string, _ syscall.RawConn) error {
+			addrPort, err := netip.ParseAddrPort(address)
+			if err != nil {
+				return err
+			}
+			return checkOutboundAddr(addrPort.Addr())
+		},
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.Proxy = nil
+	transport.DialContext = dialer.DialContext
+	return &http.Client{
+		Timeout:   timeout,
+		Transport: otelhttp.NewTransport(transport),
+		CheckRedirect: func(request *http.Request, via []*http.Request) error {
+			if len(via) >= outboundMaxRedirects {
+				return fmt.Errorf("stopped after %d redirects", outboundMaxRedirects)
+			}
+			return validateOutboundURL(request.Context(), "redirect", request.URL.String())
+		},
+	}
+}
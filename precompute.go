@@ -0,0 +1,57 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"sync/atomic"
+	"time"
+
+	"kubernetes-integration/internal/autoscale"
+)
+
+// metricsSnapshot is the outcome of a background computation of the queue metrics
+type metricsSnapshot struct {
+	metrics    map[string]autoscale.QueueMetric
+	err        error
+	computedAt time.Time
+}
+
+// metricsPrecomputer computes the queue metrics at a fixed interval, so that scrapes read the
+// latest snapshot instead of each listing the workflows
+type metricsPrecomputer struct {
+	compute  func(ctx context.Context) (map[string]autoscale.QueueMetric, error)
+	interval time.Duration
+	latest   atomic.Pointer[metricsSnapshot]
+}
+
+// newMetricsPrecomputer returns a precomputer calling compute every interval once run
+func newMetricsPrecomputer(compute func(ctx context.Context) (map[string]autoscale.QueueMetric, error), interval time.Duration) *metricsPrecomputer {
+	return &metricsPrecomputer{compute: compute, interval: interval}
+}
+
+// run computes the metrics right away, then every interval until the context is cancelled
+func (p *metricsPrecomputer) run(ctx context.Context) {
+	ticker := time.NewTicker(p.interval)
+	defer ticker.Stop()
+	for {
+		metrics, err := p.compute(ctx)
+		if ctx.Err() != nil {
+			return
+		}
+		if err != nil {
+			slog.Warn("Precomputing queue metrics failed", "error", err)
+		}
+		p.latest.Store(&metricsSnapshot{metrics: metrics, err: err, computedAt: time.Now()})
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// snapshot returns the latest computation, or nil before the first one completes
+func (p *metricsPrecomputer) snapshot() *metricsSnapshot {
+	return p.latest.Load()
+}
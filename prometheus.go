@@ -0,0 +1,130 @@
+package main
+
+import (
+	"net/http"
+	"sync"
+
+	"kubernetes-integration/internal/autoscale"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// openMetricsMIME is the media type of the OpenMetrics exposition, preferred by Prometheus scrapers
+const openMetricsMIME = "application/openmetrics-text"
+
+// scrapeErrors counts the failed computations of the queue metrics, whether for a scrape or in the background
+var scrapeErrors = prometheus.NewCounter(prometheus.CounterOpts{
+	Name: "dbos_scrape_errors_total",
+	Help: "Number of computations of the queue metrics that failed.",
+})
+
+// prometheusMetrics holds the registry served on /prometheus: the Go runtime and process
+// collectors, the enqueue latency histogram and counters, the scrape error counter, and the
+// per-queue gauges refreshed from the queue metrics on each scrape
+type prometheusMetrics struct {
+	mu      sync.Mutex
+	handler http.Handler
+
+	// aggregate returns the overall expected pods exported as the single, unlabelled dbos_expected_pods
+	// series, for KEDA's Prometheus scaler. When nil, dbos_expected_pods is labelled by queue.
+	aggregate         func(map[string]autoscale.QueueMetric) int
+	totalExpectedPods prometheus.Gauge
+
+	queueLength       *prometheus.GaugeVec
+	queueEnqueued     *prometheus.GaugeVec
+	queueRunning      *prometheus.GaugeVec
+	workerConcurrency *prometheus.GaugeVec
+	expectedPods      *prometheus.GaugeVec
+	oldestAge         *prometheus.GaugeVec
+	activeSlots       *prometheus.GaugeVec
+	totalSlots        *prometheus.GaugeVec
+}
+
+// newQueueGauge creates a gauge labelled by queue name
+func newQueueGauge(name, help string) *prometheus.GaugeVec {
+	return prometheus.NewGaugeVec(prometheus.GaugeOpts{Name: name, Help: help}, []string{"queue"})
+}
+
+// newPrometheusMetrics creates the registry and registers the runtime collectors, the uptime and the queue gauges.
+// The process collector already exports the start time as process_start_time_seconds.
+func newPrometheusMetrics(aggregate func(map[string]autoscale.QueueMetric) int) *prometheusMetrics {
+	m := &prometheusMetrics{
+		aggregate:         aggregate,
+		queueLength:       newQueueGauge("dbos_queue_length", "Number of enqueued and pending workflows in the queue."),
+		queueEnqueued:     newQueueGauge("dbos_queue_enqueued", "Number of workflows waiting to be dequeued from the queue."),
+		queueRunning:      newQueueGauge("dbos_queue_running", "Number of workflows dequeued from the queue and running."),
+		workerConcurrency: newQueueGauge("dbos_worker_concurrency", "Maximum number of workflows a single worker dequeues from the queue."),
+		expectedPods:      newQueueGauge("dbos_expected_pods", "Number of pods required to process all the queue's workflows concurrently."),
+		oldestAge:         newQueueGauge("dbos_queue_oldest_age_seconds", "Age of the oldest workflow waiting to be dequeued from the queue."),
+		activeSlots:       newQueueGauge("dbos_queue_active_slots", "Number of worker slots of the queue running a workflow."),
+		totalSlots:        newQueueGauge("dbos_queue_total_slots", "Number of worker slots of the queue's expected pods, capped by its global concurrency."),
+	}
+
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Name: "dbos_app_uptime_seconds",
+			Help: "Seconds elapsed since the application started.",
+		}, func() float64 { return uptime().Seconds() }),
+		m.queueLength,
+		m.queueEnqueued,
+		m.queueRunning,
+		m.workerConcurrency,
+		m.oldestAge,
+		m.activeSlots,
+		m.totalSlots,
+		scrapeErrors,
+	)
+	registry.MustRegister(enqueueLatency.collectors()...)
+	if aggregate != nil {
+		m.totalExpectedPods = prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: "dbos_expected_pods",
+			Help: "Number of pods required to process the workflows of all the queues, bounded by MIN_PODS and MAX_PODS.",
+		})
+		registry.MustRegister(m.totalExpectedPods)
+	} else {
+		registry.MustRegister(m.expectedPods)
+	}
+	m.handler = promhttp.HandlerFor(registry, promhttp.HandlerOpts{})
+	return m
+}
+
+// queueGauge is a gauge labelled by queue and the queue metric it reports
+type queueGauge struct {
+	vec   *prometheus.GaugeVec
+	value func(autoscale.QueueMetric) float64
+}
+
+// serve refreshes the queue gauges from the metrics and writes the whole registry.
+// The gauges are reset first so that queues which disappeared do not leave stale series behind.
+func (m *prometheusMetrics) serve(w http.ResponseWriter, r *http.Request, metrics map[string]autoscale.QueueMetric) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	gauges := []queueGauge{
+		{m.queueLength, func(q autoscale.QueueMetric) float64 { return float64(q.QueueLength) }},
+		{m.queueEnqueued, func(q autoscale.QueueMetric) float64 { return float64(q.EnqueuedCount) }},
+		{m.queueRunning, func(q autoscale.QueueMetric) float64 { return float64(q.RunningCount) }},
+		{m.workerConcurrency, func(q autoscale.QueueMetric) float64 { return float64(q.WorkerConcurrency) }},
+		{m.oldestAge, func(q autoscale.QueueMetric) float64 { return q.OldestAgeSeconds }},
+		{m.activeSlots, func(q autoscale.QueueMetric) float64 { return float64(q.ActiveSlots) }},
+		{m.totalSlots, func(q autoscale.QueueMetric) float64 { return float64(q.TotalSlots) }},
+	}
+	if m.aggregate != nil {
+		m.totalExpectedPods.Set(float64(m.aggregate(metrics)))
+	} else {
+		gauges = append(gauges, queueGauge{m.expectedPods, func(q autoscale.QueueMetric) float64 { return float64(q.ExpectedPods) }})
+	}
+	for _, gauge := range gauges {
+		gauge.vec.Reset()
+		for name, metric := range metrics {
+			gauge.vec.WithLabelValues(name).Set(gauge.value(metric))
+		}
+	}
+
+	m.handler.ServeHTTP(w, r)
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/dbos-inc/dbos-transact-golang/dbos"
+	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
+)
+
+// defaultStuckThreshold is how long a workflow must have been running for /workflows/stuck to list it
+// when threshold is not set
+const defaultStuckThreshold = 10 * time.Minute
+
+// StuckWorkflow describes a workflow running for longer than the /workflows/stuck threshold
+type StuckWorkflow struct {
+	WorkflowStatusResponse
+	ExecutorID     string    `json:"executor_id"` // Executor that last ran the workflow, which recovery takes over
+	StartedAt      time.Time `json:"started_at"`  // When the workflow was dequeued, or created if it was not enqueued
+	RunningSeconds float64   `json:"running_seconds"`
+}
+
+// stuckPageSize is how many pending workflows listStuckWorkflows reads per ListWorkflows call
+const stuckPageSize = 1000
+
+// listStuckWorkflows returns the limit workflows running the longest since before now minus threshold,
+// the longest running first, how many workflows are stuck in all and how many of them each executor
+// holds. The pending workflows are read page by page, keeping no more than limit of them.
+func listStuckWorkflows(ctx dbos.DBOSContext, threshold time.Duration, limit int) ([]StuckWorkflow, int, map[string]int, error) {
+	now := time.Now()
+	stuck := []StuckWorkflow{}
+	count := 0
+	executors := make(map[string]int)
+	for offset := 0; ; offset += stuckPageSize {
+		// A workflow cannot have started before it was created: those created since are not stuck
+		running, err := dbos.ListWorkflows(ctx,
+			dbos.WithStatus([]dbos.WorkflowStatusType{dbos.WorkflowStatusPending}),
+			dbos.WithEndTime(now.Add(-threshold)),
+			dbos.WithOffset(offset),
+			dbos.WithLimit(stuckPageSize),
+			dbos.WithLoadInput(false),
+			dbos.WithLoadOutput(false),
+		)
+		if err != nil {
+			return nil, 0, nil, err
+		}
+		for _, workflow := range running {
+			startedAt := workflow.StartedAt
+			if startedAt.IsZero() {
+				startedAt = workflow.CreatedAt
+			}
+			if now.Sub(startedAt) < threshold {
+				continue
+			}
+			stuck = append(stuck, StuckWorkflow{
+				WorkflowStatusResponse: newWorkflowStatusResponse(workflow),
+				ExecutorID:             workflow.ExecutorID,
+				StartedAt:              startedAt,
+				RunningSeconds:         now.Sub(startedAt).Seconds(),
+			})
+			count++
+			executors[workflow.ExecutorID]++
+		}
+		sort.Slice(stuck, func(i, j int) bool { return stuck[i].StartedAt.Before(stuck[j].StartedAt) })
+		if len(stuck) > limit {
+			stuck = stuck[:limit]
+		}
+		if len(running) < stuckPageSize {
+			return stuck, count, executors, nil
+		}
+	}
+}
+
+// workflowRecoverer resumes the pending workflows of executors on this pod
+type workflowRecoverer interface {
+	recoverWorkflows(ctx context.Context, executorIDs []string) ([]string, error)
+}
+
+// adminRecoverer recovers workflows through the /dbos-workflow-recovery endpoint of the DBOS admin
+// server of this pod, the only way to trigger DBOS recovery outside of its startup
+type adminRecoverer struct {
+	url    string
+	client *http.Client
+}
+
+// newAdminRecoverer returns a recoverer calling the admin server configured by config
+func newAdminRecoverer(config AppConfig) *adminRecoverer {
+	return &adminRecoverer{
+		url:    config.adminURL("/dbos-workflow-recovery"),
+		client: &http.Client{Timeout: config.AdminTimeout, Transport: otelhttp.NewTransport(http.DefaultTransport)},
+	}
+}
+
+// recoverWorkflows has the admin server recover the pending workflows of the executors, returning
+// the IDs of the recovered workflows
+func (r *adminRecoverer) recoverWorkflows(ctx context.Context, executorIDs []string) ([]string, error) {
+	body, err := json.Marshal(executorIDs)
+	if err != nil {
+		return nil, err
+	}
+	request, err := http.NewRequestWithContext(ctx, http.MethodPost, r.url, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	request.Header.Set("Content-Type", "application/json")
+	response, err := r.client.Do(request)
+	if err != nil {
+		return nil, fmt.Errorf("calling the admin server: %w", err)
+	}
+	defer response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		message, _ := io.ReadAll(io.LimitReader(response.Body, 1024))
+		return nil, fmt.Errorf("admin server answered %s: %s", response.Status, bytes.TrimSpace(message))
+	}
+	recovered := []string{}
+	if err := json.NewDecoder(response.Body).Decode(&recovered); err != nil {
+		return nil, fmt.Errorf("decoding the recovered workflows: %w", err)
+	}
+	return recovered, nil
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"os"
+	"os/signal"
+	"reflect"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+)
+
+// liveSettings are the file keys of the settings a reload applies without a restart: those of the pod
+// computation, the webhook threshold, and the limits and smoothing read by the handlers on each request.
+// The queue weights also apply live when only they changed.
+var liveSettings = []string{
+	"min_pods",
+	"max_pods",
+	"excluded_queues",
+	"scale_on_running",
+	"scale_mode",
+	"avg_workflow_duration",
+	"target_drain_time",
+	"count_source",
+	"webhook_threshold",
+	"enqueue_rate_limit",
+	"enqueue_rate_burst",
+	"max_queue_depth",
+	"max_sleep_seconds",
+	"max_concurrent",
+	"max_body_bytes",
+	"enqueue_timeout",
+	"stale_metrics_max_age",
+	"metrics_smoothing",
+	"metrics_ewma_alpha",
+}
+
+// liveConfig holds the current settings, replaced as a whole by each reload applying live ones. The
+// middlewares and handlers load it on each request rather than capturing the settings at startup.
+type liveConfig struct {
+	current atomic.Pointer[AppConfig]
+}
+
+// newLiveConfig returns a liveConfig holding config
+func newLiveConfig(config AppConfig) *liveConfig {
+	l := &liveConfig{}
+	l.store(config)
+	return l
+}
+
+// load returns the current settings, which the caller must not modify
+func (l *liveConfig) load() *AppConfig {
+	return l.current.Load()
+}
+
+// store replaces the current settings with config
+func (l *liveConfig) store(config AppConfig) {
+	l.current.Store(&config)
+}
+
+// configReloader reloads the settings on SIGHUP, applying the live ones to its subscribers
+type configReloader struct {
+	load func() (AppConfig, error)
+
+	mu          sync.Mutex
+	config      AppConfig
+	subscribers []func(AppConfig)
+}
+
+// newConfigReloader returns a reloader of the settings loaded as config, reading them again with load
+func newConfigReloader(config AppConfig, load func() (AppConfig, error)) *configReloader {
+	return &configReloader{load: load, config: config}
+}
+
+// subscribe registers apply to be called with the settings after each reload changing a live one
+func (r *configReloader) subscribe(apply func(AppConfig)) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.subscribers = append(r.subscribers, apply)
+}
+
+// run reloads the settings on every SIGHUP until ctx is done
+func (r *configReloader) run(ctx context.Context) {
+	hangup := make(chan os.Signal, 1)
+	signal.Notify(hangup, syscall.SIGHUP)
+	defer signal.Stop(hangup)
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-hangup:
+			r.reload()
+		}
+	}
+}
+
+// reload reads the settings again and applies the live ones that changed. Invalid settings are
+// rejected as a whole, and changes to the other settings are logged as requiring a restart.
+func (r *configReloader) reload() {
+	next, err := r.load()
+	if err != nil {
+		slog.Error("Reloading the configuration failed, keeping the current one", "error", err)
+		return
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	applied, restart := r.config.applyLive(next)
+	if len(restart) > 0 {
+		slog.Warn("Configuration changes require a restart to apply", "settings", restart)
+	}
+	if len(applied) == 0 {
+		slog.Info("Reloaded the configuration: no live setting changed")
+		return
+	}
+	for _, apply := range r.subscribers {
+		apply(r.config)
+	}
+	slog.Info("Reloaded the configuration", "applied", applied)
+}
+
+// applyLive copies the live settings of next into c and returns the keys of the settings which
+// changed, split into those applied and those requiring a restart
+func (c *AppConfig) applyLive(next AppConfig) (applied, restart []string) {
+	current := reflect.ValueOf(c).Elem()
+	updated := reflect.ValueOf(next)
+	for i := range current.NumField() {
+		key, _, _ := strings.Cut(current.Type().Field(i).Tag.Get("yaml"), ",")
+		if key == "queues" || reflect.DeepEqual(current.Field(i).Interface(), updated.Field(i).Interface()) {
+			continue
+		}
+		if !slices.Contains(liveSettings, key) {
+			restart = append(restart, key)
+			continue
+		}
+		current.Field(i).Set(updated.Field(i))
+		applied = append(applied, key)
+	}
+
+	// Creating or reconfiguring queues requires a restart, but their weights only matter to the pod computation
+	if !slices.Equal(c.Queues, next.Queues) {
+		if !slices.Equal(withoutWeights(c.Queues), withoutWeights(next.Queues)) {
+			restart = append(restart, "queues")
+		} else {
+			c.Queues = next.Queues
+			applied = append(applied, "queues.weight")
+		}
+	}
+	return applied, restart
+}
+
+// withoutWeights returns a copy of the queues with their weights cleared
+func withoutWeights(queues []QueueConfig) []QueueConfig {
+	cleared := slices.Clone(queues)
+	for i := range cleared {
+		cleared[i].Weight = 0
+	}
+	return cleared
+}
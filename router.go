@@ -0,0 +1,1024 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"slices"
+	"sort"
+	"strconv"
+	"time"
+
+	"kubernetes-integration/internal/autoscale"
+
+	"github.com/dbos-inc/dbos-transact-golang/dbos"
+	"github.com/gin-gonic/gin"
+	"go.opentelemetry.io/contrib/instrumentation/github.com/gin-gonic/gin/otelgin"
+)
+
+// routerDeps holds the dependencies of the HTTP handlers. DBOS is reached through the DBOSContext
+// interface and the admin server through the MetadataSource interface, so that both can be faked in tests.
+type routerDeps struct {
+	config      AppConfig
+	dbosContext dbos.DBOSContext
+	queues      []dbos.WorkflowQueue
+	metadata    autoscale.MetadataSource
+	watchdog    *progressWatchdog // nil when the liveness stall detection is disabled
+	background  context.Context   // Stops the background work, such as metrics precomputation, when done
+	purger      workflowPurger    // nil disables /admin/purge
+	recoverer   workflowRecoverer // nil disables /workflows/recover
+	leader      *leaderElector    // nil when the scheduler is disabled
+	reloader    *configReloader   // nil when the settings are not reloaded
+}
+
+// workflowPurger deletes completed workflows from the system database
+type workflowPurger interface {
+	purgeCompletedWorkflows(ctx context.Context, cutoff time.Time) (int64, error)
+}
+
+// defaultPurgeAge is the age beyond which /admin/purge deletes completed workflows when olderThan is not set
+const defaultPurgeAge = 24 * time.Hour
+
+// autoscaleConfig returns the settings of the pod computation configured by config
+func autoscaleConfig(config AppConfig) autoscale.Config {
+	queueWeights := make(map[string]float64, len(config.Queues))
+	for _, queueConfig := range config.Queues {
+		if queueConfig.Weight > 0 {
+			queueWeights[queueConfig.Name] = queueConfig.Weight
+		}
+	}
+	return autoscale.Config{
+		ScaleOnRunning:  config.ScaleOnRunning,
+		MinPods:         config.MinPods,
+		MaxPods:         config.MaxPods,
+		Mode:            autoscale.ScaleMode(config.ScaleMode),
+		AverageDuration: config.AvgWorkflowDuration,
+		TargetDrainTime: config.TargetDrainTime,
+		ExcludedQueues:  config.ExcludedQueues,
+		QueueWeights:    queueWeights,
+		CountSource:     autoscale.CountSource(config.CountSource),
+		StaleCountsAge:  config.StaleMetricsMaxAge,
+	}
+}
+
+// staleCounts reports whether the workflow counts of a queue are the last listed ones, the listing having failed
+func staleCounts(metrics map[string]autoscale.QueueMetric) bool {
+	for _, metric := range metrics {
+		if metric.CountsAgeSeconds > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// newAutoscaler returns the computer of the queue metrics and expected pods configured by config
+func newAutoscaler(config AppConfig, metadataSource autoscale.MetadataSource, dbosContext dbos.DBOSContext) *autoscale.Computer {
+	return autoscale.NewComputer(metadataSource, dbosWorkflowLister{dbosContext: dbosContext, appVersion: config.AppVersion}, autoscaleConfig(config))
+}
+
+// newRouter registers the HTTP handlers
+func newRouter(deps routerDeps) *gin.Engine {
+	config := deps.config
+	dbosContext := deps.dbosContext
+	queues := deps.queues
+	metadataSource := deps.metadata
+	watchdog := deps.watchdog
+	// The settings that a reload may change are read from live on each request
+	live := newLiveConfig(config)
+	background := deps.background
+	if background == nil {
+		background = context.Background()
+	}
+
+	// The pod computation reads the worker concurrencies through the overrides of /queues/:name/concurrency
+	concurrency := newConcurrencyOverrides(metadataSource)
+	autoscaler := newAutoscaler(config, concurrency, dbosContext)
+
+	// With METRICS_INTERVAL, the handlers read the metrics computed in the background, unless
+	// ?nocache=1 forces a fresh computation, instead of each computing them
+	// computeMetrics computes the queue metrics, counting the failed computations
+	computeMetrics := func(ctx context.Context, forceRefresh bool) (map[string]autoscale.QueueMetric, error) {
+		metrics, err := autoscaler.QueueMetrics(ctx, forceRefresh)
+		if err != nil {
+			scrapeErrors.Inc()
+		}
+		return metrics, err
+	}
+	queueMetrics := computeMetrics
+	if config.MetricsInterval > 0 {
+		precomputer := newMetricsPrecomputer(func(ctx context.Context) (map[string]autoscale.QueueMetric, error) {
+			return computeMetrics(ctx, false)
+		}, config.MetricsInterval)
+		go precomputer.run(background)
+		queueMetrics = func(ctx context.Context, forceRefresh bool) (map[string]autoscale.QueueMetric, error) {
+			if snapshot := precomputer.snapshot(); snapshot != nil && !forceRefresh {
+				return snapshot.metrics, snapshot.err
+			}
+			return computeMetrics(ctx, forceRefresh)
+		}
+	}
+
+	history := newMetricsHistory(config.MetricsHistorySize)
+	webhook := newScaleWebhook(config.WebhookURL, config.WebhookThreshold, config.WebhookTimeout)
+	// smoothPods smooths a pod estimate with METRICS_SMOOTHING and METRICS_EWMA_ALPHA,
+	// unless ?raw=1 asks for the computed estimate, which then does not count toward the smoothing
+	smoother := newPodSmoother()
+	smoothPods := func(c *gin.Context, key string, pods int) int {
+		if c.Query("raw") == "1" {
+			return pods
+		}
+		settings := live.load()
+		return smoother.smooth(key, pods, settings.MetricsSmoothing, settings.MetricsEWMAAlpha, time.Now())
+	}
+
+	// scrapeMetrics returns the queue metrics for the KEDA endpoints. When they cannot be computed, e.g. during
+	// a database outage, it returns the last known ones, flagged stale, so that the deployment holds steady
+	// rather than KEDA losing its scaler, up to STALE_METRICS_MAX_AGE. Otherwise it writes the error response.
+	lastKnown := &lastKnownMetrics{}
+	scrapeMetrics := func(c *gin.Context) (map[string]autoscale.QueueMetric, bool, bool) {
+		metrics, err := queueMetrics(c.Request.Context(), c.Query("nocache") == "1")
+		if err == nil {
+			// Counts standing in for a failed listing are stale already, and not to be kept any longer
+			if staleCounts(metrics) {
+				return metrics, true, true
+			}
+			lastKnown.store(metrics)
+			return metrics, false, true
+		}
+		if maxAge := live.load().StaleMetricsMaxAge; maxAge > 0 {
+			if metrics, age, ok := lastKnown.load(maxAge); ok {
+				slog.Warn("Serving stale queue metrics", "age", age.String(), "error", err)
+				return metrics, true, true
+			}
+		}
+		respondMetricsError(c, err)
+		return nil, false, false
+	}
+
+	r := gin.New()
+	r.Use(otelgin.Middleware(appName), requestLogger(), recoverPanics(config.Debug), encodeResponses(config.GzipMinBytes), limitBody(live))
+
+	// Index of the endpoints, so that opening the service in a browser shows it is up. Like the probes, it
+	// needs no API token and reads only the routes.
+	r.GET("/", func(c *gin.Context) {
+		routes := r.Routes()
+		sort.Slice(routes, func(i, j int) bool {
+			if routes[i].Path != routes[j].Path {
+				return routes[i].Path < routes[j].Path
+			}
+			return routes[i].Method < routes[j].Method
+		})
+		response := IndexResponse{AppName: appName, Endpoints: make([]string, 0, len(routes))}
+		for _, route := range routes {
+			response.Endpoints = append(response.Endpoints, route.Method+" "+route.Path)
+		}
+		c.JSON(http.StatusOK, response)
+	})
+
+	// Liveness probe - the process is alive as long as the router answers and, when LIVENESS_STALL_TIMEOUT
+	// is set, the queue runner has not stalled with workflows waiting for this executor
+	r.GET("/healthz", func(c *gin.Context) {
+		if watchdog != nil {
+			if stalled := watchdog.stalledFor(); stalled > 0 {
+				respondError(c, http.StatusServiceUnavailable, ErrCodeStalled, fmt.Sprintf("No workflow progress for %s despite enqueued workflows", stalled.Round(time.Second)))
+				return
+			}
+		}
+		c.JSON(http.StatusOK, gin.H{"status": "ok"})
+	})
+
+	// Readiness probe - DBOS must be launched and the admin server must have answered at least once.
+	// The database check relies on the outcome of the last metrics computation to stay cheap.
+	r.GET("/readyz", func(c *gin.Context) {
+		if readiness.shuttingDown.Load() {
+			respondErrorWithDetails(c, http.StatusServiceUnavailable, ErrCodeNotReady, "Server is shutting down", gin.H{"dependency": "server"})
+			return
+		}
+		if !readiness.dbosLaunched.Load() {
+			respondErrorWithDetails(c, http.StatusServiceUnavailable, ErrCodeNotReady, "DBOS is not launched", gin.H{"dependency": "dbos"})
+			return
+		}
+		if _, err := metadataSource.QueueMetadata(c.Request.Context(), false); err != nil {
+			respondErrorWithDetails(c, http.StatusServiceUnavailable, ErrCodeAdminUnreachable, fmt.Sprintf("Admin server unreachable: %v", err), gin.H{"dependency": "admin_server"})
+			return
+		}
+		if !readiness.databaseReachable.Load() {
+			respondErrorWithDetails(c, http.StatusServiceUnavailable, ErrCodeDatabaseError, "Database unreachable", gin.H{"dependency": "database"})
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"status": "ready"})
+	})
+
+	// Metrics endpoint for KEDA autoscaling - reports the expected pods of every queue and their max.
+	// Every scrape is recorded in the history served by /metrics/history and observed by the scale webhook.
+	// ?explain=1 adds a breakdown of the computation for debugging. Clients accepting text/plain or
+	// OpenMetrics before JSON, such as Prometheus, get the /prometheus exposition instead.
+	// PROMETHEUS_EXPECTED_PODS=aggregated, or auto with a single queue, exports dbos_expected_pods as one
+	// series of the overall expected pods, which KEDA's Prometheus scaler can query without aggregating
+	var aggregatePods func(map[string]autoscale.QueueMetric) int
+	if config.PromExpectedPods == "aggregated" || (config.PromExpectedPods == "auto" && len(queues) == 1) {
+		aggregatePods = func(metrics map[string]autoscale.QueueMetric) int {
+			pods, _ := autoscaler.ExpectedPods(metrics)
+			return pods
+		}
+	}
+	promMetrics := newPrometheusMetrics(aggregatePods)
+	r.GET("/metrics", func(c *gin.Context) {
+		metrics, stale, ok := scrapeMetrics(c)
+		if !ok {
+			return
+		}
+
+		expectedPods, capped := autoscaler.ExpectedPods(metrics)
+		expectedPods = smoothPods(c, "", expectedPods)
+		if !stale {
+			history.record(expectedPods, metrics)
+			webhook.observe(expectedPods)
+		}
+		if c.NegotiateFormat(gin.MIMEJSON, gin.MIMEPlain, openMetricsMIME) != gin.MIMEJSON {
+			promMetrics.serve(c.Writer, c.Request, metrics)
+			return
+		}
+		response := QueueMetricsResponse{
+			ExpectedPods: expectedPods,
+			Capped:       capped,
+			Stale:        stale,
+			Queues:       metrics,
+		}
+		if c.Query("explain") == "1" {
+			explanation := autoscaler.Explain(metrics)
+			response.Explain = &explanation
+		}
+		c.JSON(http.StatusOK, response)
+	})
+
+	// Recent pod estimates recorded by /metrics, oldest first
+	r.GET("/metrics/history", func(c *gin.Context) {
+		c.JSON(http.StatusOK, history.snapshot())
+	})
+
+	// Prometheus exposition of the per-queue metrics alongside the Go runtime and process metrics
+	r.GET("/prometheus", func(c *gin.Context) {
+		metrics, err := queueMetrics(c.Request.Context(), c.Query("nocache") == "1")
+		if err != nil {
+			respondMetricsError(c, err)
+			return
+		}
+
+		promMetrics.serve(c.Writer, c.Request, metrics)
+	})
+
+	// Single-value metric for KEDA's metrics-api scaler. Point the trigger's `url` at this endpoint,
+	// set `valueLocation` to the configured KEDA_METRIC_KEY (default "value") and `targetValue` to "1",
+	// since the value already is the desired number of replicas.
+	r.GET("/keda/metric", func(c *gin.Context) {
+		metrics, stale, ok := scrapeMetrics(c)
+		if !ok {
+			return
+		}
+
+		expectedPods, _ := autoscaler.ExpectedPods(metrics)
+		expectedPods = smoothPods(c, "", expectedPods)
+		response := gin.H{config.KEDAMetricKey: expectedPods}
+		if stale {
+			response["stale"] = true
+		} else {
+			webhook.observe(expectedPods)
+		}
+		c.JSON(http.StatusOK, response)
+	})
+
+	// Expected pods of a single queue, for a KEDA ScaledObject per queue: point the metrics-api trigger's
+	// `url` here and set `valueLocation` to "expected_pods". MIN_PODS and MAX_PODS do not apply, the
+	// ScaledObject's replica counts bound each queue instead.
+	r.GET("/metrics/queue/:name", func(c *gin.Context) {
+		metrics, stale, ok := scrapeMetrics(c)
+		if !ok {
+			return
+		}
+
+		queueName := c.Param("name")
+		metric, ok := metrics[queueName]
+		if !ok {
+			respondError(c, http.StatusNotFound, ErrCodeQueueNotFound, fmt.Sprintf("Unknown queue: %s", queueName))
+			return
+		}
+		response := gin.H{"expected_pods": smoothPods(c, queueName, metric.ExpectedPods)}
+		if stale {
+			response["stale"] = true
+		}
+		c.JSON(http.StatusOK, response)
+	})
+
+	// Metrics endpoint for KEDA autoscaling - accepts queue name as URL parameter
+	r.GET("/metrics/:queueName", func(c *gin.Context) {
+		queueName := c.Param("queueName")
+		workflows, err := dbos.ListWorkflows(dbosContext, dbos.WithQueuesOnly(), dbos.WithQueueName(queueName))
+		if err != nil {
+			respondMetricsError(c, err)
+			return
+		}
+
+		c.JSON(http.StatusOK, MetricsResponse{QueueLength: len(workflows)})
+	})
+
+	// The endpoints below require the API_TOKEN bearer token when it is set. The probes and
+	// the metrics endpoints above stay open so that Kubernetes and KEDA can reach them. The endpoints
+	// below, enqueues included, also share the MAX_CONCURRENT_REQUESTS limit, which the endpoints above
+	// are left out of so that a storm of enqueues does not starve the probes and scrapes.
+	api := r.Group("", apiTokenAuth(config.APIToken), limitConcurrency(live))
+
+	// Identify the application, version and queues served by this pod
+	api.GET("/info", func(c *gin.Context) {
+		queueNames := make([]string, 0, len(queues))
+		for _, queue := range queues {
+			queueNames = append(queueNames, queue.Name)
+		}
+		response := InfoResponse{
+			AppName:           appName,
+			Version:           dbosContext.GetApplicationVersion(),
+			AdminPort:         config.AdminPort,
+			Queues:            queueNames,
+			UptimeSeconds:     int64(uptime().Seconds()),
+			EnqueueAvgSeconds: enqueueLatency.average().Seconds(),
+		}
+		if deps.leader != nil {
+			leader := deps.leader.isLeader()
+			response.SchedulerLeader = &leader
+		}
+		c.JSON(http.StatusOK, response)
+	})
+
+	// List the registered queues with their live depth and expected pods
+	api.GET("/queues", func(c *gin.Context) {
+		metrics, err := queueMetrics(c.Request.Context(), c.Query("nocache") == "1")
+		if err != nil {
+			respondMetricsError(c, err)
+			return
+		}
+
+		queueSummaries := make([]QueueSummary, 0, len(metrics))
+		for _, name := range sortedQueueNames(metrics) {
+			queueSummaries = append(queueSummaries, QueueSummary{Name: name, QueueMetric: metrics[name]})
+		}
+		c.JSON(http.StatusOK, queueSummaries)
+	})
+
+	// Override the worker concurrency of a queue in the pod computation of this pod, until it restarts.
+	// The pods keep dequeuing at the registered concurrency, which DBOS cannot change at runtime.
+	api.POST("/queues/:name/concurrency", func(c *gin.Context) {
+		var request ConcurrencyOverrideRequest
+		if !bindJSON(c, &request) {
+			return
+		}
+		if request.Value == nil || *request.Value < 1 {
+			respondError(c, http.StatusBadRequest, ErrCodeInvalidBody, "value must be a positive integer")
+			return
+		}
+		queue, ok := registeredQueue(c, metadataSource, c.Param("name"))
+		if !ok {
+			return
+		}
+		concurrency.set(queue.Name, *request.Value)
+		c.JSON(http.StatusOK, gin.H{
+			"queue":                         queue.Name,
+			"worker_concurrency":            *request.Value,
+			"registered_worker_concurrency": queue.WorkerConcurrency,
+		})
+	})
+
+	// Remove the worker concurrency override of a queue
+	api.DELETE("/queues/:name/concurrency", func(c *gin.Context) {
+		queue, ok := registeredQueue(c, metadataSource, c.Param("name"))
+		if !ok {
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{
+			"queue":              queue.Name,
+			"worker_concurrency": queue.WorkerConcurrency,
+			"was_overridden":     concurrency.reset(queue.Name),
+		})
+	})
+
+	// List the most recent workflows, optionally filtered by ?status= and ?queue=, paginated with ?limit= and ?offset=
+	api.GET("/workflows", func(c *gin.Context) {
+		limit, err := strconv.Atoi(c.DefaultQuery("limit", strconv.Itoa(defaultListLimit)))
+		if err != nil || limit < 1 || limit > maxListLimit {
+			respondError(c, http.StatusBadRequest, ErrCodeInvalidParameter, fmt.Sprintf("Invalid limit: must be an integer between 1 and %d", maxListLimit))
+			return
+		}
+		offset, err := strconv.Atoi(c.DefaultQuery("offset", "0"))
+		if err != nil || offset < 0 {
+			respondError(c, http.StatusBadRequest, ErrCodeInvalidParameter, "Invalid offset: must be a non-negative integer")
+			return
+		}
+
+		opts := []dbos.ListWorkflowsOption{
+			dbos.WithLimit(limit),
+			dbos.WithOffset(offset),
+			dbos.WithSortDesc(),
+			dbos.WithLoadInput(false),
+			dbos.WithLoadOutput(false),
+		}
+		if status := c.Query("status"); status != "" {
+			statuses, ok := workflowStatusFilter(status)
+			if !ok {
+				respondErrorWithDetails(c, http.StatusBadRequest, ErrCodeInvalidParameter, fmt.Sprintf("Invalid status: %s", status), gin.H{
+					"valid_statuses": []string{workflowStatusQueued, workflowStatusRunning, workflowStatusSucceeded, workflowStatusFailed, workflowStatusCancelled},
+					"raw_statuses":   workflowStatuses,
+				})
+				return
+			}
+			opts = append(opts, dbos.WithStatus(statuses))
+		}
+		if queueName := c.Query("queue"); queueName != "" {
+			opts = append(opts, dbos.WithQueueName(queueName))
+		}
+
+		workflows, err := dbos.ListWorkflows(dbosContext, opts...)
+		if err != nil {
+			respondError(c, http.StatusInternalServerError, ErrCodeDatabaseError, fmt.Sprintf("Error listing workflows: %v", err))
+			return
+		}
+
+		responses := make([]WorkflowStatusResponse, 0, len(workflows))
+		for _, workflow := range workflows {
+			responses = append(responses, newWorkflowStatusResponse(workflow))
+		}
+		c.JSON(http.StatusOK, gin.H{
+			"workflows": responses,
+			"limit":     limit,
+			"offset":    offset,
+		})
+	})
+
+	// List the workflows running for longer than ?threshold= (a duration, default 10m), such as those
+	// left pending by a pod that died before DBOS recovered them, keeping the queues from draining
+	api.GET("/workflows/stuck", func(c *gin.Context) {
+		threshold := defaultStuckThreshold
+		if value := c.Query("threshold"); value != "" {
+			var err error
+			if threshold, err = time.ParseDuration(value); err != nil || threshold <= 0 {
+				respondError(c, http.StatusBadRequest, ErrCodeInvalidParameter, fmt.Sprintf("Invalid threshold %q: must be a positive duration such as 10m", value))
+				return
+			}
+		}
+		limit, err := strconv.Atoi(c.DefaultQuery("limit", strconv.Itoa(defaultListLimit)))
+		if err != nil || limit < 1 || limit > maxListLimit {
+			respondError(c, http.StatusBadRequest, ErrCodeInvalidParameter, fmt.Sprintf("Invalid limit: must be an integer between 1 and %d", maxListLimit))
+			return
+		}
+		stuck, count, executors, err := listStuckWorkflows(dbosContext, threshold, limit)
+		if err != nil {
+			respondError(c, http.StatusInternalServerError, ErrCodeDatabaseError, fmt.Sprintf("Error listing workflows: %v", err))
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{
+			"workflows": stuck,
+			"count":     count,
+			"executors": executors,
+			"threshold": threshold.String(),
+			"limit":     limit,
+		})
+	})
+
+	// Have this pod take over the pending workflows of the executors in the body, through DBOS recovery.
+	// Recovering an executor that is still alive runs its workflows twice, so this pod's own executor,
+	// which pods share unless their executor IDs are set, is refused.
+	if deps.recoverer != nil {
+		api.POST("/workflows/recover", func(c *gin.Context) {
+			var request RecoverRequest
+			if !bindJSON(c, &request) {
+				return
+			}
+			if len(request.ExecutorIDs) == 0 {
+				respondError(c, http.StatusBadRequest, ErrCodeInvalidBody, "executor_ids is required, see the executors of /workflows/stuck")
+				return
+			}
+			if own := dbosContext.GetExecutorID(); slices.Contains(request.ExecutorIDs, own) {
+				respondError(c, http.StatusBadRequest, ErrCodeInvalidBody, fmt.Sprintf("Executor %s is this pod's own: its workflows are already running here", own))
+				return
+			}
+			recovered, err := deps.recoverer.recoverWorkflows(c.Request.Context(), request.ExecutorIDs)
+			if err != nil {
+				respondError(c, http.StatusInternalServerError, ErrCodeAdminUnreachable, fmt.Sprintf("Error recovering workflows: %v", err))
+				return
+			}
+			slog.Info("Recovered workflows", "request_id", requestID(c), "executor_ids", request.ExecutorIDs, "recovered", len(recovered))
+			c.JSON(http.StatusOK, gin.H{"recovered": recovered, "executor_ids": request.ExecutorIDs})
+		})
+	}
+
+	// Retrieve the status of a single workflow, and its result once completed
+	api.GET("/workflow/:id", func(c *gin.Context) {
+		workflowID := c.Param("id")
+		status, err := getWorkflowStatus(dbosContext, workflowID)
+		if err != nil {
+			respondError(c, http.StatusInternalServerError, ErrCodeDatabaseError, fmt.Sprintf("Error retrieving workflow: %v", err))
+			return
+		}
+		if status == nil {
+			respondError(c, http.StatusNotFound, ErrCodeWorkflowNotFound, fmt.Sprintf("Workflow not found: %s", workflowID))
+			return
+		}
+
+		c.JSON(http.StatusOK, newWorkflowStatusResponse(*status))
+	})
+
+	// Wait for a workflow to complete, up to ?timeout= (default 30s, at most 5m), and return its result
+	api.GET("/workflow/:id/result", func(c *gin.Context) {
+		workflowID := c.Param("id")
+		timeout := defaultResultTimeout
+		if value := c.Query("timeout"); value != "" {
+			var err error
+			timeout, err = time.ParseDuration(value)
+			if err != nil || timeout <= 0 || timeout > maxResultTimeout {
+				respondError(c, http.StatusBadRequest, ErrCodeInvalidDuration, fmt.Sprintf("Invalid timeout %q: must be a positive duration of at most %s", value, maxResultTimeout))
+				return
+			}
+		}
+
+		handle, err := dbos.RetrieveWorkflow[any](dbosContext, workflowID)
+		if errors.Is(err, &dbos.DBOSError{Code: dbos.NonExistentWorkflowError}) {
+			respondError(c, http.StatusNotFound, ErrCodeWorkflowNotFound, fmt.Sprintf("Workflow not found: %s", workflowID))
+			return
+		}
+		if err != nil {
+			respondError(c, http.StatusInternalServerError, ErrCodeDatabaseError, fmt.Sprintf("Error retrieving workflow: %v", err))
+			return
+		}
+
+		result, resultErr := handle.GetResult(dbos.WithHandleTimeout(timeout))
+		if errors.Is(resultErr, context.DeadlineExceeded) {
+			respondError(c, http.StatusGatewayTimeout, ErrCodeWorkflowTimeout, fmt.Sprintf("Workflow %s did not complete within %s", workflowID, timeout))
+			return
+		}
+		status, err := handle.GetStatus()
+		if err != nil {
+			respondError(c, http.StatusInternalServerError, ErrCodeDatabaseError, fmt.Sprintf("Error retrieving workflow status: %v", err))
+			return
+		}
+
+		response := workflowStatusDetails(status)
+		response["workflow_id"] = workflowID
+		response["result"] = result
+		if resultErr != nil {
+			response["error"] = resultErr.Error()
+		}
+		c.JSON(http.StatusOK, response)
+	})
+
+	// Cancel a pending or enqueued workflow. Enqueued workflows are removed from their queue.
+	api.POST("/workflow/:id/cancel", func(c *gin.Context) {
+		workflowID := c.Param("id")
+		status, err := getWorkflowStatus(dbosContext, workflowID)
+		if err != nil {
+			respondError(c, http.StatusInternalServerError, ErrCodeDatabaseError, fmt.Sprintf("Error retrieving workflow: %v", err))
+			return
+		}
+		if status == nil {
+			respondError(c, http.StatusNotFound, ErrCodeWorkflowNotFound, fmt.Sprintf("Workflow not found: %s", workflowID))
+			return
+		}
+		if isTerminalStatus(status.Status) {
+			respondErrorWithDetails(c, http.StatusConflict, ErrCodeWorkflowCompleted, fmt.Sprintf("Workflow %s already completed", workflowID), workflowStatusDetails(*status))
+			return
+		}
+
+		if err := dbos.CancelWorkflow(dbosContext, workflowID); err != nil {
+			respondError(c, http.StatusInternalServerError, ErrCodeDatabaseError, fmt.Sprintf("Error cancelling workflow: %v", err))
+			return
+		}
+		slog.Info("Workflow cancelled", "request_id", requestID(c), "workflow_id", workflowID)
+
+		status, err = getWorkflowStatus(dbosContext, workflowID)
+		if err != nil || status == nil {
+			respondError(c, http.StatusInternalServerError, ErrCodeDatabaseError, fmt.Sprintf("Error retrieving cancelled workflow: %v", err))
+			return
+		}
+		c.JSON(http.StatusOK, newWorkflowStatusResponse(*status))
+	})
+
+	// Retry a workflow that ended without succeeding, as a new run forked from its input.
+	// DBOS runs forks on its internal queue, so the retry does not count towards the original queue.
+	api.POST("/workflow/:id/retry", func(c *gin.Context) {
+		workflowID := c.Param("id")
+		status, err := getWorkflowStatus(dbosContext, workflowID)
+		if err != nil {
+			respondError(c, http.StatusInternalServerError, ErrCodeDatabaseError, fmt.Sprintf("Error retrieving workflow: %v", err))
+			return
+		}
+		if status == nil {
+			respondError(c, http.StatusNotFound, ErrCodeWorkflowNotFound, fmt.Sprintf("Workflow not found: %s", workflowID))
+			return
+		}
+		if !isTerminalStatus(status.Status) {
+			respondErrorWithDetails(c, http.StatusConflict, ErrCodeWorkflowActive, fmt.Sprintf("Workflow %s is still running", workflowID), workflowStatusDetails(*status))
+			return
+		}
+		if status.Status == dbos.WorkflowStatusSuccess {
+			respondErrorWithDetails(c, http.StatusConflict, ErrCodeWorkflowCompleted, fmt.Sprintf("Workflow %s succeeded, nothing to retry", workflowID), workflowStatusDetails(*status))
+			return
+		}
+
+		handle, err := dbos.ForkWorkflow[any](dbosContext, dbos.ForkWorkflowInput{OriginalWorkflowID: workflowID})
+		if err != nil {
+			respondError(c, http.StatusInternalServerError, ErrCodeDatabaseError, fmt.Sprintf("Error retrying workflow: %v", err))
+			return
+		}
+		slog.Info("Workflow retried", "request_id", requestID(c), "workflow_id", workflowID, "retry_workflow_id", handle.GetWorkflowID())
+		c.JSON(http.StatusOK, gin.H{
+			"workflow_id":  handle.GetWorkflowID(),
+			"retried_from": workflowID,
+		})
+	})
+
+	// Delete the completed workflows older than ?olderThan= (a duration, default 24h), which otherwise
+	// accumulate in the system database. Enqueued and running workflows are kept whatever their age.
+	if deps.purger != nil {
+		api.POST("/admin/purge", func(c *gin.Context) {
+			olderThan := defaultPurgeAge
+			if value := c.Query("olderThan"); value != "" {
+				var err error
+				if olderThan, err = time.ParseDuration(value); err != nil || olderThan <= 0 {
+					respondError(c, http.StatusBadRequest, ErrCodeInvalidParameter, fmt.Sprintf("Invalid olderThan %q: must be a positive duration such as 24h", value))
+					return
+				}
+			}
+			cutoff := time.Now().Add(-olderThan)
+			deleted, err := deps.purger.purgeCompletedWorkflows(c.Request.Context(), cutoff)
+			if err != nil {
+				respondError(c, http.StatusInternalServerError, ErrCodeDatabaseError, fmt.Sprintf("Error purging workflows: %v", err))
+				return
+			}
+			slog.Info("Purged completed workflows", "request_id", requestID(c), "older_than", olderThan.String(), "deleted", deleted)
+			c.JSON(http.StatusOK, gin.H{"deleted": deleted, "cutoff": cutoff})
+		})
+	}
+
+	// Stop accepting workflows ahead of a scale-down, e.g. from a preStop hook. The response
+	// counts the workflows left on the queues, then /drain/status tracks them until none is left.
+	drain := newDrainer(background, func(ctx context.Context) (int, error) {
+		metrics, err := queueMetrics(ctx, false)
+		if err != nil {
+			return 0, err
+		}
+		remaining := 0
+		for _, metric := range metrics {
+			remaining += metric.QueueLength
+		}
+		return remaining, nil
+	})
+	api.POST("/drain", func(c *gin.Context) {
+		c.JSON(http.StatusAccepted, drain.start(c.Request.Context()))
+	})
+	api.GET("/drain/status", func(c *gin.Context) {
+		c.JSON(http.StatusOK, drain.snapshot())
+	})
+
+	// Enqueue responses include estimated_start_in_seconds, a best-effort estimate of the wait before the
+	// workflow starts, using AVG_WORKFLOW_DURATION or else the duration of recently completed workflows
+	estimator := newStartEstimator(dbosContext, func(ctx context.Context) (map[string]autoscale.QueueMetric, error) {
+		return queueMetrics(ctx, false)
+	}, config.AvgWorkflowDuration)
+
+	// SIGHUP applies the live settings to the pod computation, the start estimates, the webhook,
+	// and the limits and smoothing read from live
+	if deps.reloader != nil {
+		deps.reloader.subscribe(func(config AppConfig) {
+			live.store(config)
+			autoscaler.SetConfig(autoscaleConfig(config))
+			estimator.setAverageDuration(config.AvgWorkflowDuration)
+			webhook.setThreshold(config.WebhookThreshold)
+		})
+	}
+
+	// With MAX_QUEUE_DEPTH, the enqueues on a queue already holding that many workflows fail with 429
+	backlogLimit := newBackpressure(func(ctx context.Context) (map[string]autoscale.QueueMetric, error) {
+		return queueMetrics(ctx, false)
+	}, live)
+
+	// The enqueue endpoints are rejected while draining and share a rate limit, off unless ENQUEUE_RATE_LIMIT is set
+	enqueue := api.Group("", rejectWhileDraining(drain), rateLimit(live))
+
+	// Handler to enqueue a workflow with configurable sleep duration, on the queue selected with ?queue=.
+	// ?dedup_id= rejects the workflow with 409 while another one with the same ID is enqueued or running.
+	enqueue.GET("/enqueue/:duration", func(c *gin.Context) {
+		settings := live.load()
+		// Get duration from URL path parameter
+		durationStr := c.Param("duration")
+		duration, err := strconv.Atoi(durationStr)
+		if err != nil || duration <= 0 || duration > settings.MaxSleepSeconds {
+			respondError(c, http.StatusBadRequest, ErrCodeInvalidDuration, fmt.Sprintf("Invalid duration %q: must be an integer between 1 and %d seconds", durationStr, settings.MaxSleepSeconds))
+			return
+		}
+
+		queue, ok := selectQueue(c, queues)
+		if !ok {
+			return
+		}
+		if !backlogLimit.admit(c, queue.Name) {
+			return
+		}
+
+		input := SleepWorkflowInput{
+			DurationSeconds: duration,
+		}
+
+		options, ok := enqueueOptionsFromQuery(c)
+		if !ok {
+			return
+		}
+		enqueueSleepWorkflow(c, dbosContext, estimator, queue, input, options, settings.EnqueueTimeout)
+	})
+
+	// Handler to enqueue a sleep workflow described by a JSON body
+	enqueue.POST("/enqueue", func(c *gin.Context) {
+		settings := live.load()
+		var request EnqueueRequest
+		if !bindJSON(c, &request) {
+			return
+		}
+		if request.DurationSeconds == nil {
+			respondError(c, http.StatusBadRequest, ErrCodeInvalidBody, "duration_seconds is required")
+			return
+		}
+		input := SleepWorkflowInput{DurationSeconds: *request.DurationSeconds}
+		if err := input.validate(settings.MaxSleepSeconds); err != nil {
+			respondError(c, http.StatusBadRequest, ErrCodeInvalidDuration, fmt.Sprintf("Invalid workflow input: %v", err))
+			return
+		}
+
+		queue, ok := findQueue(c, queues, request.Queue)
+		if !ok {
+			return
+		}
+		if !backlogLimit.admit(c, queue.Name) {
+			return
+		}
+
+		options, ok := enqueueOptionsFromQuery(c)
+		if !ok {
+			return
+		}
+		if request.Priority != nil {
+			options.priority = request.Priority
+		}
+		if request.IdempotencyKey != "" {
+			options.idempotencyKey = request.IdempotencyKey
+		}
+		if request.DeduplicationID != "" {
+			options.deduplicationID = request.DeduplicationID
+		}
+		if request.TimeoutSeconds != nil {
+			options.timeoutSeconds = request.TimeoutSeconds
+		}
+		if request.CallbackURL != "" {
+			options.callbackURL = request.CallbackURL
+		}
+		enqueueSleepWorkflow(c, dbosContext, estimator, queue, input, options, settings.EnqueueTimeout)
+	})
+
+	// Handler to enqueue a workflow with a sleep duration in milliseconds, on the queue selected with ?queue=
+	enqueue.GET("/enqueue/ms/:duration", func(c *gin.Context) {
+		settings := live.load()
+		duration, err := strconv.Atoi(c.Param("duration"))
+		if err != nil || duration <= 0 || duration > settings.MaxSleepSeconds*1000 {
+			respondError(c, http.StatusBadRequest, ErrCodeInvalidDuration, fmt.Sprintf("Invalid duration %q: must be an integer between 1 and %d milliseconds", c.Param("duration"), settings.MaxSleepSeconds*1000))
+			return
+		}
+
+		queue, ok := selectQueue(c, queues)
+		if !ok {
+			return
+		}
+		if !backlogLimit.admit(c, queue.Name) {
+			return
+		}
+
+		options, ok := enqueueOptionsFromQuery(c)
+		if !ok {
+			return
+		}
+		enqueueSleepWorkflow(c, dbosContext, estimator, queue, SleepWorkflowInput{DurationMillis: duration}, options, settings.EnqueueTimeout)
+	})
+
+	// Handler to enqueue a CPU-bound workflow computing the n-th Fibonacci number, on the queue selected with ?queue=
+	enqueue.GET("/enqueue/fib/:n", func(c *gin.Context) {
+		settings := live.load()
+		n, err := strconv.Atoi(c.Param("n"))
+		if err != nil || n < 0 || n > maxFibonacciN {
+			respondError(c, http.StatusBadRequest, ErrCodeInvalidParameter, fmt.Sprintf("Invalid n: must be an integer between 0 and %d", maxFibonacciN))
+			return
+		}
+
+		queue, ok := selectQueue(c, queues)
+		if !ok {
+			return
+		}
+		if !backlogLimit.admit(c, queue.Name) {
+			return
+		}
+
+		ctx, cancel := enqueueContext(c, settings.EnqueueTimeout)
+		defer cancel()
+		start := time.Now()
+		handle, err := enqueueWithin(ctx, func() (dbos.WorkflowHandle[string], error) {
+			return dbos.RunWorkflow(dbosContext, FibonacciWorkflow, FibonacciWorkflowInput{N: n, RequestID: requestID(c)}, dbos.WithQueue(queue.Name))
+		})
+		enqueueLatency.observe(start, queue.Name, err)
+		if respondEnqueueInterrupted(c, err, settings.EnqueueTimeout, nil) {
+			return
+		}
+		if err != nil {
+			respondError(c, http.StatusInternalServerError, ErrCodeEnqueueFailed, fmt.Sprintf("Error enqueuing workflow: %v", err))
+			return
+		}
+
+		logEnqueued(c, handle.GetWorkflowID(), queue.Name)
+		response := gin.H{
+			"message":     "Workflow enqueued successfully",
+			"workflow_id": handle.GetWorkflowID(),
+			"n":           n,
+			"queue":       queue.Name,
+		}
+		addStartEstimate(c, response, estimator, queue.Name, settings.EnqueueTimeout)
+		c.JSON(http.StatusOK, response)
+	})
+
+	// Handler to enqueue a workflow GETting ?url= in a durable step, on the queue selected with ?queue=
+	enqueue.GET("/enqueue/fetch", func(c *gin.Context) {
+		settings := live.load()
+		input := FetchWorkflowInput{URL: c.Query("url"), RequestID: requestID(c)}
+		if err := input.validate(c.Request.Context()); err != nil {
+			respondError(c, http.StatusBadRequest, ErrCodeInvalidParameter, fmt.Sprintf("Invalid workflow input: %v", err))
+			return
+		}
+
+		queue, ok := selectQueue(c, queues)
+		if !ok {
+			return
+		}
+		if !backlogLimit.admit(c, queue.Name) {
+			return
+		}
+
+		ctx, cancel := enqueueContext(c, settings.EnqueueTimeout)
+		defer cancel()
+		start := time.Now()
+		handle, err := enqueueWithin(ctx, func() (dbos.WorkflowHandle[int], error) {
+			return dbos.RunWorkflow(dbosContext, FetchWorkflow, input, dbos.WithQueue(queue.Name))
+		})
+		enqueueLatency.observe(start, queue.Name, err)
+		if respondEnqueueInterrupted(c, err, settings.EnqueueTimeout, nil) {
+			return
+		}
+		if err != nil {
+			respondError(c, http.StatusInternalServerError, ErrCodeEnqueueFailed, fmt.Sprintf("Error enqueuing workflow: %v", err))
+			return
+		}
+
+		logEnqueued(c, handle.GetWorkflowID(), queue.Name)
+		response := gin.H{
+			"message":     "Workflow enqueued successfully",
+			"workflow_id": handle.GetWorkflowID(),
+			"url":         input.URL,
+			"queue":       queue.Name,
+		}
+		addStartEstimate(c, response, estimator, queue.Name, settings.EnqueueTimeout)
+		c.JSON(http.StatusOK, response)
+	})
+
+	// Handler to enqueue a workflow running sequential durable steps of ?step_seconds= each (default 1),
+	// on the queue selected with ?queue=. ?fail_first_attempt=1 makes a step fail once to show step retries.
+	enqueue.GET("/enqueue/multistep", func(c *gin.Context) {
+		settings := live.load()
+		stepSeconds, err := strconv.Atoi(c.DefaultQuery("step_seconds", "1"))
+		if err != nil || stepSeconds < 0 || stepSeconds > settings.MaxSleepSeconds {
+			respondError(c, http.StatusBadRequest, ErrCodeInvalidDuration, fmt.Sprintf("Invalid step_seconds: must be an integer between 0 and %d", settings.MaxSleepSeconds))
+			return
+		}
+
+		queue, ok := selectQueue(c, queues)
+		if !ok {
+			return
+		}
+		if !backlogLimit.admit(c, queue.Name) {
+			return
+		}
+
+		input := MultiStepWorkflowInput{
+			StepSeconds:      stepSeconds,
+			FailFirstAttempt: c.Query("fail_first_attempt") == "1",
+			RequestID:        requestID(c),
+		}
+		ctx, cancel := enqueueContext(c, settings.EnqueueTimeout)
+		defer cancel()
+		start := time.Now()
+		handle, err := enqueueWithin(ctx, func() (dbos.WorkflowHandle[string], error) {
+			return dbos.RunWorkflow(dbosContext, MultiStepWorkflow, input, dbos.WithQueue(queue.Name))
+		})
+		enqueueLatency.observe(start, queue.Name, err)
+		if respondEnqueueInterrupted(c, err, settings.EnqueueTimeout, nil) {
+			return
+		}
+		if err != nil {
+			respondError(c, http.StatusInternalServerError, ErrCodeEnqueueFailed, fmt.Sprintf("Error enqueuing workflow: %v", err))
+			return
+		}
+
+		logEnqueued(c, handle.GetWorkflowID(), queue.Name)
+		response := gin.H{
+			"message":            "Workflow enqueued successfully",
+			"workflow_id":        handle.GetWorkflowID(),
+			"step_seconds":       stepSeconds,
+			"fail_first_attempt": input.FailFirstAttempt,
+			"queue":              queue.Name,
+		}
+		addStartEstimate(c, response, estimator, queue.Name, settings.EnqueueTimeout)
+		c.JSON(http.StatusOK, response)
+	})
+
+	// Handler to enqueue one sleep workflow per duration of a JSON array
+	enqueue.POST("/enqueue/batch", func(c *gin.Context) {
+		settings := live.load()
+		var request BatchEnqueueRequest
+		if !bindJSON(c, &request) {
+			return
+		}
+		if len(request.Durations) == 0 {
+			respondError(c, http.StatusBadRequest, ErrCodeInvalidBody, "durations must not be empty")
+			return
+		}
+		if len(request.Durations) > maxBatchSize {
+			respondError(c, http.StatusBadRequest, ErrCodeInvalidBody, fmt.Sprintf("Batch too large: %d durations, at most %d allowed", len(request.Durations), maxBatchSize))
+			return
+		}
+
+		for i, duration := range request.Durations {
+			if err := (SleepWorkflowInput{DurationSeconds: duration}).validate(settings.MaxSleepSeconds); err != nil {
+				respondError(c, http.StatusBadRequest, ErrCodeInvalidDuration, fmt.Sprintf("Invalid workflow input at index %d: %v", i, err))
+				return
+			}
+		}
+
+		queue, ok := selectQueue(c, queues)
+		if !ok {
+			return
+		}
+		if !backlogLimit.admit(c, queue.Name) {
+			return
+		}
+
+		// The timeout bounds the whole batch: the durations not yet enqueued when it expires are dropped
+		ctx, cancel := enqueueContext(c, settings.EnqueueTimeout)
+		defer cancel()
+		workflowIDs := make([]string, 0, len(request.Durations))
+		var failed int
+		var firstErr error
+		for _, duration := range request.Durations {
+			start := time.Now()
+			handle, err := enqueueWithin(ctx, func() (dbos.WorkflowHandle[string], error) {
+				return dbos.RunWorkflow(dbosContext, SleepWorkflow, SleepWorkflowInput{DurationSeconds: duration, RequestID: requestID(c)}, dbos.WithQueue(queue.Name))
+			})
+			enqueueLatency.observe(start, queue.Name, err)
+			if respondEnqueueInterrupted(c, err, settings.EnqueueTimeout, gin.H{
+				"workflow_ids": workflowIDs,
+				"queue":        queue.Name,
+			}) {
+				return
+			}
+			if err != nil {
+				failed++
+				if firstErr == nil {
+					firstErr = err
+				}
+				continue
+			}
+			logEnqueued(c, handle.GetWorkflowID(), queue.Name)
+			workflowIDs = append(workflowIDs, handle.GetWorkflowID())
+		}
+
+		if failed > 0 {
+			status := http.StatusMultiStatus
+			if len(workflowIDs) == 0 {
+				status = http.StatusInternalServerError
+			}
+			respondErrorWithDetails(c, status, ErrCodeEnqueueFailed, fmt.Sprintf("%d of %d workflows failed to enqueue: %v", failed, len(request.Durations), firstErr), gin.H{
+				"workflow_ids": workflowIDs,
+				"queue":        queue.Name,
+			})
+			return
+		}
+
+		c.JSON(http.StatusOK, gin.H{
+			"message":      "Workflows enqueued successfully",
+			"workflow_ids": workflowIDs,
+			"queue":        queue.Name,
+		})
+	})
+
+	return r
+}
@@ -0,0 +1,1469 @@
+package main
+
+import (
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"kubernetes-integration/internal/autoscale"
+
+	"github.com/dbos-inc/dbos-transact-golang/dbos"
+	"github.com/gin-gonic/gin"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestMain(m *testing.M) {
+	gin.SetMode(gin.TestMode)
+	slog.SetDefault(slog.New(slog.NewTextHandler(io.Discard, nil)))
+	os.Exit(m.Run())
+}
+
+// fakeDBOS implements the DBOSContext methods used by the handlers. Calling any other method panics.
+type fakeDBOS struct {
+	dbos.DBOSContext
+	workflows []dbos.WorkflowStatus // Returned by ListWorkflows
+	listErr   error                 // Returned by ListWorkflows
+	runErr    error                 // Returned by RunWorkflow
+	inputs    []any                 // Inputs of the workflows started with RunWorkflow
+	forked    []string              // Workflows forked with ForkWorkflow
+	runBlock  <-chan struct{}       // If set, RunWorkflow waits for it to be closed, then fails
+	running   chan<- struct{}       // If set, RunWorkflow sends on it before waiting for runBlock
+	enqueueOn string                // If set, RunWorkflow adds an ENQUEUED workflow on this queue to workflows
+	listBlock <-chan struct{}       // If set, ListWorkflows waits for it to be closed
+}
+
+func (f *fakeDBOS) RunWorkflow(_ dbos.DBOSContext, _ dbos.WorkflowFunc, input any, _ ...dbos.WorkflowOption) (dbos.WorkflowHandle[any], error) {
+	if f.runBlock != nil {
+		if f.running != nil {
+			f.running <- struct{}{}
+		}
+		<-f.runBlock
+		return nil, errors.New("unblocked")
+	}
+	if f.runErr != nil {
+		return nil, f.runErr
+	}
+	f.inputs = append(f.inputs, input)
+	if f.enqueueOn != "" {
+		f.workflows = append(f.workflows, dbos.WorkflowStatus{QueueName: f.enqueueOn, Status: dbos.WorkflowStatusEnqueued})
+	}
+	return fakeHandle{id: "wf-1"}, nil
+}
+
+func (f *fakeDBOS) ListWorkflows(dbos.DBOSContext, ...dbos.ListWorkflowsOption) ([]dbos.WorkflowStatus, error) {
+	if f.listBlock != nil {
+		<-f.listBlock
+	}
+	return f.workflows, f.listErr
+}
+
+func (f *fakeDBOS) GetExecutorID() string {
+	return "local"
+}
+
+func (f *fakeDBOS) ForkWorkflow(_ dbos.DBOSContext, input dbos.ForkWorkflowInput) (dbos.WorkflowHandle[any], error) {
+	f.forked = append(f.forked, input.OriginalWorkflowID)
+	return fakeHandle{id: "wf-retry"}, nil
+}
+
+type fakeHandle struct {
+	id string
+}
+
+func (h fakeHandle) GetResult(...dbos.GetResultOption) (any, error) { return nil, nil }
+func (h fakeHandle) GetStatus() (dbos.WorkflowStatus, error) {
+	return dbos.WorkflowStatus{ID: h.id}, nil
+}
+func (h fakeHandle) GetWorkflowID() string { return h.id }
+
+type fakeMetadataSource struct {
+	queues []autoscale.QueueMetadata
+	err    error
+}
+
+func (f fakeMetadataSource) QueueMetadata(_ context.Context, _ bool) ([]autoscale.QueueMetadata, error) {
+	return f.queues, f.err
+}
+
+// testConfig returns the default configuration, as loadConfig would without env vars
+func testConfig() AppConfig {
+	return AppConfig{
+		MaxSleepSeconds:    3600,
+		MinPods:            1,
+		ScaleOnRunning:     true,
+		ScaleMode:          "backlog",
+		MetricsHistorySize: 10,
+		KEDAMetricKey:      "value",
+		MaxBodyBytes:       1 << 20,
+	}
+}
+
+// serve sends a request to a router built from the dependencies and returns the recorded response
+func serve(t *testing.T, deps routerDeps, method, target string, header http.Header) *httptest.ResponseRecorder {
+	return serveBody(t, deps, method, target, header, nil)
+}
+
+// serveBody is serve with a request body
+func serveBody(t *testing.T, deps routerDeps, method, target string, header http.Header, body io.Reader) *httptest.ResponseRecorder {
+	t.Helper()
+	if deps.queues == nil {
+		deps.queues = []dbos.WorkflowQueue{{Name: "q"}}
+	}
+	if deps.metadata == nil {
+		deps.metadata = fakeMetadataSource{}
+	}
+	req := httptest.NewRequest(method, target, body)
+	for name, values := range header {
+		req.Header[name] = values
+	}
+	w := httptest.NewRecorder()
+	newRouter(deps).ServeHTTP(w, req)
+	return w
+}
+
+// assertAPIError decodes an error response, failing the test if it does not have the expected status and code
+func assertAPIError(t *testing.T, w *httptest.ResponseRecorder, wantStatus int, wantCode string) {
+	t.Helper()
+	if w.Code != wantStatus {
+		t.Fatalf("status = %d, want %d (body %s)", w.Code, wantStatus, w.Body)
+	}
+	var apiErr APIError
+	if err := json.Unmarshal(w.Body.Bytes(), &apiErr); err != nil {
+		t.Fatalf("decoding error body %s: %v", w.Body, err)
+	}
+	if apiErr.Code != wantCode || apiErr.Message == "" {
+		t.Errorf("error = %+v, want code %s with a message", apiErr, wantCode)
+	}
+}
+
+// queuedWorkflows returns n ENQUEUED workflows on the given queue
+func queuedWorkflows(queueName string, n int) []dbos.WorkflowStatus {
+	workflows := make([]dbos.WorkflowStatus, n)
+	for i := range workflows {
+		workflows[i] = dbos.WorkflowStatus{QueueName: queueName, Status: dbos.WorkflowStatusEnqueued}
+	}
+	return workflows
+}
+
+func TestEnqueueDuration(t *testing.T) {
+	fake := &fakeDBOS{}
+	w := serve(t, routerDeps{config: testConfig(), dbosContext: fake}, http.MethodGet, "/enqueue/10", http.Header{"X-Request-Id": {"req-1"}})
+	if w.Code != http.StatusOK {
+		t.Fatalf("status = %d, want 200 (body %s)", w.Code, w.Body)
+	}
+	var body struct {
+		WorkflowID string `json:"workflow_id"`
+		Queue      string `json:"queue"`
+		Duration   int    `json:"duration"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil {
+		t.Fatalf("decoding body %s: %v", w.Body, err)
+	}
+	if body.WorkflowID != "wf-1" || body.Queue != "q" || body.Duration != 10 {
+		t.Errorf("body = %+v, want workflow wf-1 on queue q with duration 10", body)
+	}
+	if len(fake.inputs) != 1 || fake.inputs[0] != (SleepWorkflowInput{DurationSeconds: 10, RequestID: "req-1"}) {
+		t.Errorf("started workflows with inputs %v, want a single 10s sleep", fake.inputs)
+	}
+}
+
+func TestEnqueueCallbackURL(t *testing.T) {
+	fake := &fakeDBOS{}
+	header := http.Header{"X-Request-Id": {"req-1"}}
+	w := serve(t, routerDeps{config: testConfig(), dbosContext: fake}, http.MethodGet, "/enqueue/10?callback_url=https://93.184.215.14/done", header)
+	if w.Code != http.StatusOK {
+		t.Fatalf("GET: status = %d, want 200 (body %s)", w.Code, w.Body)
+	}
+	w = serveBody(t, routerDeps{config: testConfig(), dbosContext: fake}, http.MethodPost, "/enqueue?callback_url=https://93.184.215.14/ignored", header,
+		strings.NewReader(`{"duration_seconds": 5, "callback_url": "http://203.0.113.7/done"}`))
+	if w.Code != http.StatusOK {
+		t.Fatalf("POST: status = %d, want 200 (body %s)", w.Code, w.Body)
+	}
+	want := []any{
+		SleepWorkflowInput{DurationSeconds: 10, CallbackURL: "https://93.184.215.14/done", RequestID: "req-1"},
+		SleepWorkflowInput{DurationSeconds: 5, CallbackURL: "http://203.0.113.7/done", RequestID: "req-1"},
+	}
+	if !slices.Equal(fake.inputs, want) {
+		t.Errorf("started workflows with inputs %v, want %v", fake.inputs, want)
+	}
+}
+
+func TestEnqueueRequestID(t *testing.T) {
+	fake := &fakeDBOS{}
+	deps := routerDeps{config: testConfig(), dbosContext: fake}
+	header := http.Header{"X-Request-Id": {"req-1"}}
+	for _, target := range []string{"/enqueue/1", "/enqueue/ms/500", "/enqueue/fib/10", "/enqueue/multistep"} {
+		if w := serve(t, deps, http.MethodGet, target, header); w.Code != http.StatusOK {
+			t.Fatalf("GET %s: status = %d, want 200 (body %s)", target, w.Code, w.Body)
+		}
+	}
+	if w := serveBody(t, deps, http.MethodPost, "/enqueue/batch", header, strings.NewReader(`{"durations": [1, 2]}`)); w.Code != http.StatusOK {
+		t.Fatalf("POST /enqueue/batch: status = %d, want 200 (body %s)", w.Code, w.Body)
+	}
+	want := []any{
+		SleepWorkflowInput{DurationSeconds: 1, RequestID: "req-1"},
+		SleepWorkflowInput{DurationMillis: 500, RequestID: "req-1"},
+		FibonacciWorkflowInput{N: 10, RequestID: "req-1"},
+		MultiStepWorkflowInput{StepSeconds: 1, RequestID: "req-1"},
+		SleepWorkflowInput{DurationSeconds: 1, RequestID: "req-1"},
+		SleepWorkflowInput{DurationSeconds: 2, RequestID: "req-1"},
+	}
+	if !slices.Equal(fake.inputs, want) {
+		t.Errorf("started workflows with inputs %v, want %v, all carrying the request ID", fake.inputs, want)
+	}
+}
+
+func TestEnqueueDurationErrors(t *testing.T) {
+	tests := []struct {
+		name       string
+		target     string
+		runErr     error
+		wantStatus int
+		wantCode   string
+	}{
+		{name: "not a number", target: "/enqueue/abc", wantStatus: http.StatusBadRequest, wantCode: ErrCodeInvalidDuration},
+		{name: "zero", target: "/enqueue/0", wantStatus: http.StatusBadRequest, wantCode: ErrCodeInvalidDuration},
+		{name: "negative", target: "/enqueue/-1", wantStatus: http.StatusBadRequest, wantCode: ErrCodeInvalidDuration},
+		{name: "above the maximum", target: "/enqueue/3601", wantStatus: http.StatusBadRequest, wantCode: ErrCodeInvalidDuration},
+		{name: "unknown queue", target: "/enqueue/10?queue=missing", wantStatus: http.StatusBadRequest, wantCode: ErrCodeQueueNotFound},
+		{name: "invalid timeout", target: "/enqueue/10?timeout_seconds=soon", wantStatus: http.StatusBadRequest, wantCode: ErrCodeInvalidParameter},
+		{name: "zero timeout", target: "/enqueue/10?timeout_seconds=0", wantStatus: http.StatusBadRequest, wantCode: ErrCodeInvalidParameter},
+		{name: "relative callback URL", target: "/enqueue/10?callback_url=/done", wantStatus: http.StatusBadRequest, wantCode: ErrCodeInvalidParameter},
+		{name: "non-http callback URL", target: "/enqueue/10?callback_url=ftp://example.com/done", wantStatus: http.StatusBadRequest, wantCode: ErrCodeInvalidParameter},
+		{name: "loopback callback URL", target: "/enqueue/10?callback_url=http://127.0.0.1:3001/dbos-workflow-recovery", wantStatus: http.StatusBadRequest, wantCode: ErrCodeInvalidParameter},
+		{name: "metadata callback URL", target: "/enqueue/10?callback_url=http://169.254.169.254/latest/meta-data", wantStatus: http.StatusBadRequest, wantCode: ErrCodeInvalidParameter},
+		{name: "enqueue failure", target: "/enqueue/10", runErr: errors.New("database down"), wantStatus: http.StatusInternalServerError, wantCode: ErrCodeEnqueueFailed},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fake := &fakeDBOS{runErr: tt.runErr}
+			w := serve(t, routerDeps{config: testConfig(), dbosContext: fake}, http.MethodGet, tt.target, nil)
+			assertAPIError(t, w, tt.wantStatus, tt.wantCode)
+			if tt.runErr == nil && len(fake.inputs) != 0 {
+				t.Errorf("started workflows with inputs %v, want none", fake.inputs)
+			}
+		})
+	}
+}
+
+func TestMetrics(t *testing.T) {
+	fake := &fakeDBOS{workflows: []dbos.WorkflowStatus{
+		{QueueName: "q", Status: dbos.WorkflowStatusEnqueued},
+		{QueueName: "q", Status: dbos.WorkflowStatusEnqueued},
+		{QueueName: "q", Status: dbos.WorkflowStatusPending},
+	}}
+	metadata := fakeMetadataSource{queues: []autoscale.QueueMetadata{{Name: "q", WorkerConcurrency: 2}}}
+
+	w := serve(t, routerDeps{config: testConfig(), dbosContext: fake, metadata: metadata}, http.MethodGet, "/metrics", nil)
+	if w.Code != http.StatusOK {
+		t.Fatalf("status = %d, want 200 (body %s)", w.Code, w.Body)
+	}
+	var body QueueMetricsResponse
+	if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil {
+		t.Fatalf("decoding body %s: %v", w.Body, err)
+	}
+	if body.ExpectedPods != 2 || body.Queues["q"].QueueLength != 3 || body.Queues["q"].RunningCount != 1 {
+		t.Errorf("body = %+v, want 2 expected pods for a queue of length 3 with 1 running", body)
+	}
+}
+
+func TestMetricsAdminUnreachable(t *testing.T) {
+	metadata := fakeMetadataSource{err: errors.New("connection refused")}
+	w := serve(t, routerDeps{config: testConfig(), dbosContext: &fakeDBOS{}, metadata: metadata}, http.MethodGet, "/metrics", nil)
+	assertAPIError(t, w, http.StatusInternalServerError, ErrCodeAdminUnreachable)
+}
+
+func TestMetricsStale(t *testing.T) {
+	fake := &fakeDBOS{workflows: queuedWorkflows("q", 4)}
+	metadata := fakeMetadataSource{queues: []autoscale.QueueMetadata{{Name: "q", WorkerConcurrency: 2}}}
+	config := testConfig()
+	config.StaleMetricsMaxAge = 50 * time.Millisecond
+	r := newRouter(routerDeps{config: config, dbosContext: fake, queues: []dbos.WorkflowQueue{{Name: "q"}}, metadata: metadata})
+	scrape := func() (*httptest.ResponseRecorder, QueueMetricsResponse) {
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+		var body QueueMetricsResponse
+		json.Unmarshal(w.Body.Bytes(), &body)
+		return w, body
+	}
+
+	if w, body := scrape(); w.Code != http.StatusOK || body.Stale {
+		t.Fatalf("healthy scrape: status = %d, stale = %t, want 200 and fresh (body %s)", w.Code, body.Stale, w.Body)
+	}
+
+	fake.listErr = errors.New("database down")
+	w, body := scrape()
+	if w.Code != http.StatusOK || !body.Stale || body.ExpectedPods != 2 {
+		t.Errorf("scrape during outage: status = %d, body %s, want 200 with the last known 2 pods, stale", w.Code, w.Body)
+	}
+
+	time.Sleep(60 * time.Millisecond)
+	w, _ = scrape()
+	assertAPIError(t, w, http.StatusInternalServerError, ErrCodeDatabaseError)
+}
+
+func TestAPIToken(t *testing.T) {
+	config := testConfig()
+	config.APIToken = "secret"
+	deps := routerDeps{
+		config:      config,
+		dbosContext: &fakeDBOS{},
+		metadata:    fakeMetadataSource{queues: []autoscale.QueueMetadata{{Name: "q", WorkerConcurrency: 1}}},
+	}
+
+	assertAPIError(t, serve(t, deps, http.MethodGet, "/enqueue/1", nil), http.StatusUnauthorized, ErrCodeUnauthorized)
+	assertAPIError(t, serve(t, deps, http.MethodGet, "/enqueue/1", http.Header{"Authorization": {"Bearer wrong"}}), http.StatusUnauthorized, ErrCodeUnauthorized)
+	if w := serve(t, deps, http.MethodGet, "/enqueue/1", http.Header{"Authorization": {"Bearer secret"}}); w.Code != http.StatusOK {
+		t.Errorf("authenticated enqueue: status = %d, want 200 (body %s)", w.Code, w.Body)
+	}
+	if w := serve(t, deps, http.MethodGet, "/metrics", nil); w.Code != http.StatusOK {
+		t.Errorf("unauthenticated /metrics: status = %d, want 200 (body %s)", w.Code, w.Body)
+	}
+}
+
+func TestEnqueueRateLimit(t *testing.T) {
+	config := testConfig()
+	config.EnqueueRateLimit = 0.01
+	config.EnqueueRateBurst = 2
+	r := newRouter(routerDeps{config: config, dbosContext: &fakeDBOS{}, queues: []dbos.WorkflowQueue{{Name: "q"}}, metadata: fakeMetadataSource{}})
+
+	for i, wantStatus := range []int{http.StatusOK, http.StatusOK, http.StatusTooManyRequests} {
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/enqueue/1", nil))
+		if w.Code != wantStatus {
+			t.Fatalf("request %d: status = %d, want %d (body %s)", i, w.Code, wantStatus, w.Body)
+		}
+		if wantStatus == http.StatusTooManyRequests {
+			assertAPIError(t, w, http.StatusTooManyRequests, ErrCodeRateLimited)
+			if retryAfter := w.Header().Get("Retry-After"); retryAfter != "100" {
+				t.Errorf("Retry-After = %q, want 100", retryAfter)
+			}
+		}
+	}
+
+	// Other endpoints are not limited
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+	if w.Code == http.StatusTooManyRequests {
+		t.Errorf("/readyz was rate limited")
+	}
+}
+
+func TestScaleWebhook(t *testing.T) {
+	events := make(chan ScaleEvent, 10)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var event ScaleEvent
+		if err := json.NewDecoder(r.Body).Decode(&event); err != nil {
+			t.Errorf("decoding scale event: %v", err)
+		}
+		events <- event
+	}))
+	defer server.Close()
+
+	webhook := newScaleWebhook(server.URL, 2, time.Second)
+	// Fires on the crossings to 3 and 5 only
+	for _, expectedPods := range []int{1, 3, 4, 2, 5} {
+		webhook.observe(expectedPods)
+	}
+
+	var received []int
+	for range 2 {
+		select {
+		case event := <-events:
+			if event.Threshold != 2 || event.Event != "expected_pods_above_threshold" {
+				t.Errorf("event = %+v, want an expected_pods_above_threshold event with threshold 2", event)
+			}
+			received = append(received, event.ExpectedPods)
+		case <-time.After(5 * time.Second):
+			t.Fatalf("received events for %v, want 2 events", received)
+		}
+	}
+	slices.Sort(received)
+	if !slices.Equal(received, []int{3, 5}) {
+		t.Errorf("received events for %v, want [3 5]", received)
+	}
+	select {
+	case event := <-events:
+		t.Errorf("unexpected event %+v", event)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func TestDrain(t *testing.T) {
+	fake := &fakeDBOS{workflows: []dbos.WorkflowStatus{{QueueName: "q", Status: dbos.WorkflowStatusPending}}}
+	metadata := fakeMetadataSource{queues: []autoscale.QueueMetadata{{Name: "q", WorkerConcurrency: 1}}}
+	r := newRouter(routerDeps{config: testConfig(), dbosContext: fake, queues: []dbos.WorkflowQueue{{Name: "q"}}, metadata: metadata})
+	request := func(method, target string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, httptest.NewRequest(method, target, nil))
+		return w
+	}
+
+	if w := request(http.MethodGet, "/enqueue/1"); w.Code != http.StatusOK {
+		t.Fatalf("enqueue before drain: status = %d, want 200 (body %s)", w.Code, w.Body)
+	}
+
+	w := request(http.MethodPost, "/drain")
+	if w.Code != http.StatusAccepted {
+		t.Fatalf("drain: status = %d, want 202 (body %s)", w.Code, w.Body)
+	}
+	var status DrainStatus
+	if err := json.Unmarshal(w.Body.Bytes(), &status); err != nil {
+		t.Fatalf("decoding body %s: %v", w.Body, err)
+	}
+	if !status.Draining || status.Drained || status.Remaining != 1 {
+		t.Errorf("drain status = %+v, want draining with 1 remaining workflow", status)
+	}
+
+	assertAPIError(t, request(http.MethodGet, "/enqueue/1"), http.StatusServiceUnavailable, ErrCodeDraining)
+	if w := request(http.MethodGet, "/drain/status"); w.Code != http.StatusOK {
+		t.Errorf("drain status: status = %d, want 200 (body %s)", w.Code, w.Body)
+	}
+}
+
+func TestDrainerStopsOnShutdown(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	var counts atomic.Int32
+	drain := newDrainer(ctx, func(context.Context) (int, error) {
+		counts.Add(1)
+		return 1, nil
+	})
+	drain.pollInterval = time.Millisecond
+	drain.start(context.Background())
+	cancel()
+	// Let a poll that was under way when the context was cancelled complete
+	time.Sleep(10 * time.Millisecond)
+	before := counts.Load()
+	time.Sleep(20 * time.Millisecond)
+	if after := counts.Load(); after != before {
+		t.Errorf("counted the remaining workflows %d times after shutdown, want 0", after-before)
+	}
+}
+
+func TestMetricsQueue(t *testing.T) {
+	fake := &fakeDBOS{workflows: queuedWorkflows("b", 5)}
+	metadata := fakeMetadataSource{queues: []autoscale.QueueMetadata{{Name: "a", WorkerConcurrency: 1}, {Name: "b", WorkerConcurrency: 2}}}
+	deps := routerDeps{config: testConfig(), dbosContext: fake, metadata: metadata}
+
+	w := serve(t, deps, http.MethodGet, "/metrics/queue/b", nil)
+	if w.Code != http.StatusOK {
+		t.Fatalf("status = %d, want 200 (body %s)", w.Code, w.Body)
+	}
+	if body := w.Body.String(); body != `{"expected_pods":3}` {
+		t.Errorf("body = %s, want {\"expected_pods\":3}", body)
+	}
+	// The MIN_PODS floor does not apply to a single queue
+	if w := serve(t, deps, http.MethodGet, "/metrics/queue/a", nil); w.Body.String() != `{"expected_pods":0}` {
+		t.Errorf("empty queue: body = %s, want {\"expected_pods\":0}", w.Body)
+	}
+	assertAPIError(t, serve(t, deps, http.MethodGet, "/metrics/queue/missing", nil), http.StatusNotFound, ErrCodeQueueNotFound)
+}
+
+func TestEnqueueBodyLimits(t *testing.T) {
+	config := testConfig()
+	config.MaxBodyBytes = 64
+	tests := []struct {
+		name       string
+		body       io.Reader
+		wantStatus int
+		wantCode   string
+	}{
+		{name: "declared length too large", body: strings.NewReader(`{"duration_seconds": 1, "queue": "` + strings.Repeat("q", 100) + `"}`), wantStatus: http.StatusRequestEntityTooLarge, wantCode: ErrCodePayloadTooLarge},
+		// Hide the length so that only the body reader enforces the limit
+		{name: "streamed body too large", body: io.MultiReader(strings.NewReader(`{"queue": "` + strings.Repeat("q", 100) + `"}`)), wantStatus: http.StatusRequestEntityTooLarge, wantCode: ErrCodePayloadTooLarge},
+		{name: "invalid input", body: strings.NewReader(`{"duration_seconds": 3601}`), wantStatus: http.StatusBadRequest, wantCode: ErrCodeInvalidDuration},
+		{name: "zero duration", body: strings.NewReader(`{"duration_seconds": 0}`), wantStatus: http.StatusBadRequest, wantCode: ErrCodeInvalidDuration},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fake := &fakeDBOS{}
+			w := serveBody(t, routerDeps{config: config, dbosContext: fake}, http.MethodPost, "/enqueue", http.Header{"Content-Type": {"application/json"}}, tt.body)
+			assertAPIError(t, w, tt.wantStatus, tt.wantCode)
+			if len(fake.inputs) != 0 {
+				t.Errorf("started workflows with inputs %v, want none", fake.inputs)
+			}
+		})
+	}
+
+	fake := &fakeDBOS{}
+	w := serveBody(t, routerDeps{config: config, dbosContext: fake}, http.MethodPost, "/enqueue", http.Header{"Content-Type": {"application/json"}}, strings.NewReader(`{"duration_seconds": 5}`))
+	if w.Code != http.StatusOK || len(fake.inputs) != 1 {
+		t.Errorf("body within the limit: status = %d with inputs %v, want 200 with one workflow (body %s)", w.Code, fake.inputs, w.Body)
+	}
+}
+
+func TestEnqueueStartEstimate(t *testing.T) {
+	metadata := fakeMetadataSource{queues: []autoscale.QueueMetadata{{Name: "q", WorkerConcurrency: 2}}}
+	estimateWith := func(t *testing.T, config AppConfig, fake *fakeDBOS) any {
+		t.Helper()
+		w := serve(t, routerDeps{config: config, dbosContext: fake, metadata: metadata}, http.MethodGet, "/enqueue/1", nil)
+		if w.Code != http.StatusOK {
+			t.Fatalf("status = %d, want 200 (body %s)", w.Code, w.Body)
+		}
+		var body map[string]any
+		if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil {
+			t.Fatalf("decoding body %s: %v", w.Body, err)
+		}
+		return body["estimated_start_in_seconds"]
+	}
+	estimate := func(t *testing.T, config AppConfig, workflows []dbos.WorkflowStatus) any {
+		t.Helper()
+		return estimateWith(t, config, &fakeDBOS{workflows: workflows})
+	}
+
+	// 5 workflows ahead, run 2 at a time on each of the 3 expected pods, lasting 12s each
+	config := testConfig()
+	config.AvgWorkflowDuration = 12 * time.Second
+	if got := estimate(t, config, queuedWorkflows("q", 5)); got != 10.0 {
+		t.Errorf("estimated_start_in_seconds = %v, want 10", got)
+	}
+	if got := estimate(t, config, nil); got != 0.0 {
+		t.Errorf("empty queue: estimated_start_in_seconds = %v, want 0", got)
+	}
+	// Without a configured duration nor completed workflows to measure it, there is no estimate
+	if got := estimate(t, testConfig(), queuedWorkflows("q", 5)); got != nil {
+		t.Errorf("unknown duration: estimated_start_in_seconds = %v, want none", got)
+	}
+
+	// A failing computation leaves the estimate out of the response
+	if got := estimateWith(t, config, &fakeDBOS{listErr: errors.New("database down")}); got != nil {
+		t.Errorf("failing computation: estimated_start_in_seconds = %v, want none", got)
+	}
+
+	// So does one hanging on the database, given up after ENQUEUE_TIMEOUT
+	block := make(chan struct{})
+	t.Cleanup(func() { close(block) })
+	config.EnqueueTimeout = 20 * time.Millisecond
+	start := time.Now()
+	if got := estimateWith(t, config, &fakeDBOS{listBlock: block}); got != nil {
+		t.Errorf("hanging computation: estimated_start_in_seconds = %v, want none", got)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("hanging computation: answered after %s, want within ENQUEUE_TIMEOUT", elapsed)
+	}
+}
+
+func TestMetricsPrecomputer(t *testing.T) {
+	computed := make(chan struct{}, 10)
+	precomputer := newMetricsPrecomputer(func(context.Context) (map[string]autoscale.QueueMetric, error) {
+		computed <- struct{}{}
+		return map[string]autoscale.QueueMetric{"q": {QueueLength: 3}}, nil
+	}, time.Hour)
+	if precomputer.snapshot() != nil {
+		t.Fatal("snapshot before the first computation, want nil")
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	stopped := make(chan struct{})
+	go func() {
+		precomputer.run(ctx)
+		close(stopped)
+	}()
+
+	// The first computation happens right away, not after the interval
+	select {
+	case <-computed:
+	case <-time.After(5 * time.Second):
+		t.Fatal("metrics were not computed on start")
+	}
+	cancel()
+	select {
+	case <-stopped:
+	case <-time.After(5 * time.Second):
+		t.Fatal("run did not return once the context was cancelled")
+	}
+	if snapshot := precomputer.snapshot(); snapshot == nil || snapshot.metrics["q"].QueueLength != 3 {
+		t.Errorf("snapshot = %+v, want the computed metrics", snapshot)
+	}
+}
+
+func TestRetryWorkflow(t *testing.T) {
+	tests := []struct {
+		status   dbos.WorkflowStatusType
+		wantCode string // Empty when the retry succeeds
+	}{
+		{dbos.WorkflowStatusError, ""},
+		{dbos.WorkflowStatusCancelled, ""},
+		{dbos.WorkflowStatusMaxRecoveryAttemptsExceeded, ""},
+		{dbos.WorkflowStatusPending, ErrCodeWorkflowActive},
+		{dbos.WorkflowStatusEnqueued, ErrCodeWorkflowActive},
+		{dbos.WorkflowStatusSuccess, ErrCodeWorkflowCompleted},
+	}
+	for _, tt := range tests {
+		t.Run(string(tt.status), func(t *testing.T) {
+			fake := &fakeDBOS{workflows: []dbos.WorkflowStatus{{ID: "wf-1", QueueName: "q", Status: tt.status}}}
+			w := serve(t, routerDeps{config: testConfig(), dbosContext: fake}, http.MethodPost, "/workflow/wf-1/retry", nil)
+			if tt.wantCode != "" {
+				assertAPIError(t, w, http.StatusConflict, tt.wantCode)
+				if len(fake.forked) != 0 {
+					t.Errorf("forked %v, want no fork", fake.forked)
+				}
+				var body struct {
+					Details map[string]string `json:"details"`
+				}
+				json.Unmarshal(w.Body.Bytes(), &body)
+				if body.Details["status"] != workflowStatusNames[tt.status] || body.Details["raw_status"] != string(tt.status) {
+					t.Errorf("details = %v, want status %s and raw_status %s", body.Details, workflowStatusNames[tt.status], tt.status)
+				}
+				return
+			}
+			if w.Code != http.StatusOK {
+				t.Fatalf("status = %d, want 200 (body %s)", w.Code, w.Body)
+			}
+			var body struct {
+				WorkflowID  string `json:"workflow_id"`
+				RetriedFrom string `json:"retried_from"`
+			}
+			if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil {
+				t.Fatalf("decoding body %s: %v", w.Body, err)
+			}
+			if body.WorkflowID != "wf-retry" || body.RetriedFrom != "wf-1" || len(fake.forked) != 1 {
+				t.Errorf("body = %+v, forked %v, want wf-retry forked from wf-1", body, fake.forked)
+			}
+		})
+	}
+
+	w := serve(t, routerDeps{config: testConfig(), dbosContext: &fakeDBOS{}}, http.MethodPost, "/workflow/missing/retry", nil)
+	assertAPIError(t, w, http.StatusNotFound, ErrCodeWorkflowNotFound)
+}
+
+func TestWorkflowStatusTimedOut(t *testing.T) {
+	deadline := time.Now().Add(-time.Minute)
+	tests := []struct {
+		name       string
+		status     dbos.WorkflowStatus
+		wantStatus string
+	}{
+		{"cancelled at its deadline", dbos.WorkflowStatus{Status: dbos.WorkflowStatusCancelled, Deadline: deadline, UpdatedAt: deadline.Add(time.Millisecond)}, workflowStatusTimedOut},
+		{"cancelled before its deadline", dbos.WorkflowStatus{Status: dbos.WorkflowStatusCancelled, Deadline: deadline, UpdatedAt: deadline.Add(-time.Second)}, workflowStatusCancelled},
+		{"cancelled without timeout", dbos.WorkflowStatus{Status: dbos.WorkflowStatusCancelled, UpdatedAt: deadline}, workflowStatusCancelled},
+		{"completed before its deadline", dbos.WorkflowStatus{Status: dbos.WorkflowStatusSuccess, Deadline: deadline, UpdatedAt: deadline}, workflowStatusSucceeded},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.status.ID = "wf-1"
+			fake := &fakeDBOS{workflows: []dbos.WorkflowStatus{tt.status}}
+			w := serve(t, routerDeps{config: testConfig(), dbosContext: fake}, http.MethodGet, "/workflow/wf-1", nil)
+			if w.Code != http.StatusOK {
+				t.Fatalf("status = %d, want 200 (body %s)", w.Code, w.Body)
+			}
+			var response WorkflowStatusResponse
+			if err := json.Unmarshal(w.Body.Bytes(), &response); err != nil {
+				t.Fatalf("decoding body %s: %v", w.Body, err)
+			}
+			if response.Status != tt.wantStatus {
+				t.Errorf("status = %s, want %s", response.Status, tt.wantStatus)
+			}
+		})
+	}
+}
+
+func TestRecoverPanics(t *testing.T) {
+	for _, includeStack := range []bool{false, true} {
+		t.Run(fmt.Sprintf("includeStack=%t", includeStack), func(t *testing.T) {
+			r := gin.New()
+			r.Use(requestLogger(), recoverPanics(includeStack))
+			r.GET("/panic", func(*gin.Context) { panic("boom") })
+			w := httptest.NewRecorder()
+			r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/panic", nil))
+
+			assertAPIError(t, w, http.StatusInternalServerError, ErrCodeInternal)
+			if got := strings.Contains(w.Body.String(), "goroutine"); got != includeStack {
+				t.Errorf("stack in body = %t, want %t (body %s)", got, includeStack, w.Body)
+			}
+		})
+	}
+}
+
+func TestMetricsSmoothing(t *testing.T) {
+	for _, tt := range []struct {
+		name     string
+		window   time.Duration
+		alpha    float64
+		wantPods []int
+	}{
+		{"none", 0, 0, []int{2, 1, 3}},
+		{"window", time.Hour, 0, []int{2, 2, 3}},
+		{"ewma", 0, 0.5, []int{2, 2, 3}},
+		{"ewma then window", time.Hour, 0.2, []int{2, 2, 3}},
+		// Rising from 1.8 to 2.04, the average is rounded up without the tolerance
+		{"ewma rising", 0, 0.2, []int{2, 2, 3}},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			config := testConfig()
+			config.MetricsSmoothing = tt.window
+			config.MetricsEWMAAlpha = tt.alpha
+			fake := &fakeDBOS{}
+			metadata := fakeMetadataSource{queues: []autoscale.QueueMetadata{{Name: "q", WorkerConcurrency: 2}}}
+			r := newRouter(routerDeps{config: config, dbosContext: fake, queues: []dbos.WorkflowQueue{{Name: "q"}}, metadata: metadata})
+
+			for i, queued := range []int{4, 0, 6} {
+				fake.workflows = queuedWorkflows("q", queued)
+				w := httptest.NewRecorder()
+				r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/keda/metric", nil))
+				var body map[string]int
+				if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil {
+					t.Fatalf("decoding body %s: %v", w.Body, err)
+				}
+				if body["value"] != tt.wantPods[i] {
+					t.Errorf("scrape %d with %d queued: value = %d, want %d", i, queued, body["value"], tt.wantPods[i])
+				}
+			}
+
+			fake.workflows = nil
+			w := httptest.NewRecorder()
+			r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/keda/metric?raw=1", nil))
+			if !strings.Contains(w.Body.String(), `"value":1`) {
+				t.Errorf("raw scrape with nothing queued: body %s, want value 1", w.Body)
+			}
+		})
+	}
+}
+
+func TestPodSmootherEWMASettles(t *testing.T) {
+	s := newPodSmoother()
+	now := time.Now()
+	s.smooth("q", 10, 0, 0.5, now)
+	// Decreasing, the average only approaches 1: the tolerance lets it settle there
+	pods := 0
+	for range 10 {
+		pods = s.smooth("q", 1, 0, 0.5, now)
+	}
+	if pods != 1 {
+		t.Errorf("decreasing from 10 to 1: pods = %d, want 1", pods)
+	}
+	// Rising, the average is rounded up in full: 2.004 requires 3 pods
+	if pods := s.smooth("q", 3, 0, 0.5, now); pods != 3 {
+		t.Errorf("rising from 1 to 3: pods = %d, want 3", pods)
+	}
+}
+
+type fakePurger struct {
+	cutoff time.Time // Cutoff of the last purge
+}
+
+func (f *fakePurger) purgeCompletedWorkflows(_ context.Context, cutoff time.Time) (int64, error) {
+	f.cutoff = cutoff
+	return 3, nil
+}
+
+func TestAdminPurge(t *testing.T) {
+	purger := &fakePurger{}
+	deps := routerDeps{config: testConfig(), dbosContext: &fakeDBOS{}, purger: purger}
+
+	w := serve(t, deps, http.MethodPost, "/admin/purge?olderThan=2h", nil)
+	if w.Code != http.StatusOK {
+		t.Fatalf("status = %d, want 200 (body %s)", w.Code, w.Body)
+	}
+	var body struct {
+		Deleted int64 `json:"deleted"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil {
+		t.Fatalf("decoding body %s: %v", w.Body, err)
+	}
+	if body.Deleted != 3 {
+		t.Errorf("deleted = %d, want 3", body.Deleted)
+	}
+	if age := time.Since(purger.cutoff); age < 2*time.Hour || age > 2*time.Hour+time.Minute {
+		t.Errorf("cutoff %s ago, want 2h", age)
+	}
+
+	for _, olderThan := range []string{"yesterday", "-1h", "0s"} {
+		w := serve(t, deps, http.MethodPost, "/admin/purge?olderThan="+olderThan, nil)
+		assertAPIError(t, w, http.StatusBadRequest, ErrCodeInvalidParameter)
+	}
+
+	config := testConfig()
+	config.APIToken = "secret"
+	w = serve(t, routerDeps{config: config, dbosContext: &fakeDBOS{}, purger: purger}, http.MethodPost, "/admin/purge", nil)
+	assertAPIError(t, w, http.StatusUnauthorized, ErrCodeUnauthorized)
+}
+
+func TestStuckWorkflows(t *testing.T) {
+	now := time.Now()
+	fake := &fakeDBOS{workflows: []dbos.WorkflowStatus{
+		{ID: "recent", Status: dbos.WorkflowStatusPending, ExecutorID: "pod-a", StartedAt: now.Add(-time.Minute)},
+		{ID: "old", Status: dbos.WorkflowStatusPending, ExecutorID: "pod-b", StartedAt: now.Add(-20 * time.Minute)},
+		{ID: "older", Status: dbos.WorkflowStatusPending, ExecutorID: "pod-b", CreatedAt: now.Add(-time.Hour)},
+	}}
+	deps := routerDeps{config: testConfig(), dbosContext: fake}
+
+	w := serve(t, deps, http.MethodGet, "/workflows/stuck", nil)
+	if w.Code != http.StatusOK {
+		t.Fatalf("status = %d, want 200 (body %s)", w.Code, w.Body)
+	}
+	var body struct {
+		Workflows []StuckWorkflow `json:"workflows"`
+		Executors map[string]int  `json:"executors"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil {
+		t.Fatalf("decoding body %s: %v", w.Body, err)
+	}
+	var ids []string
+	for _, workflow := range body.Workflows {
+		ids = append(ids, workflow.WorkflowID)
+	}
+	if !slices.Equal(ids, []string{"older", "old"}) || body.Executors["pod-b"] != 2 || len(body.Executors) != 1 {
+		t.Errorf("stuck = %v on executors %v, want older then old, both on pod-b", ids, body.Executors)
+	}
+	if got := body.Workflows[0]; got.Status != workflowStatusRunning || got.RunningSeconds < 3599 {
+		t.Errorf("older = %+v, want RUNNING for an hour", got)
+	}
+
+	w = serve(t, deps, http.MethodGet, "/workflows/stuck?threshold=30s", nil)
+	if !strings.Contains(w.Body.String(), `"count":3`) {
+		t.Errorf("threshold=30s: body %s, want the 3 workflows", w.Body)
+	}
+	for _, threshold := range []string{"soon", "-1m", "0s"} {
+		assertAPIError(t, serve(t, deps, http.MethodGet, "/workflows/stuck?threshold="+threshold, nil), http.StatusBadRequest, ErrCodeInvalidParameter)
+	}
+
+	w = serve(t, deps, http.MethodGet, "/workflows/stuck?limit=1", nil)
+	body.Workflows = nil
+	if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil {
+		t.Fatalf("decoding body %s: %v", w.Body, err)
+	}
+	if len(body.Workflows) != 1 || body.Workflows[0].WorkflowID != "older" || !strings.Contains(w.Body.String(), `"count":2`) {
+		t.Errorf("limit=1: body %s, want older alone out of 2", w.Body)
+	}
+	for _, limit := range []string{"0", "501", "many"} {
+		assertAPIError(t, serve(t, deps, http.MethodGet, "/workflows/stuck?limit="+limit, nil), http.StatusBadRequest, ErrCodeInvalidParameter)
+	}
+}
+
+type fakeRecoverer struct {
+	executorIDs []string // Executors of the last recovery
+}
+
+func (f *fakeRecoverer) recoverWorkflows(_ context.Context, executorIDs []string) ([]string, error) {
+	f.executorIDs = executorIDs
+	return []string{"wf-1", "wf-2"}, nil
+}
+
+func TestRecoverWorkflows(t *testing.T) {
+	recoverer := &fakeRecoverer{}
+	deps := routerDeps{config: testConfig(), dbosContext: &fakeDBOS{}, recoverer: recoverer}
+
+	w := serveBody(t, deps, http.MethodPost, "/workflows/recover", nil, strings.NewReader(`{"executor_ids": ["pod-b"]}`))
+	if w.Code != http.StatusOK {
+		t.Fatalf("status = %d, want 200 (body %s)", w.Code, w.Body)
+	}
+	if !slices.Equal(recoverer.executorIDs, []string{"pod-b"}) || !strings.Contains(w.Body.String(), `"recovered":["wf-1","wf-2"]`) {
+		t.Errorf("recovered executors %v, body %s", recoverer.executorIDs, w.Body)
+	}
+
+	for _, body := range []string{`{}`, `{"executor_ids": []}`, `{"executor_ids": ["pod-b", "local"]}`} {
+		recoverer.executorIDs = nil
+		assertAPIError(t, serveBody(t, deps, http.MethodPost, "/workflows/recover", nil, strings.NewReader(body)), http.StatusBadRequest, ErrCodeInvalidBody)
+		if recoverer.executorIDs != nil {
+			t.Errorf("%s: recovered executors %v, want none", body, recoverer.executorIDs)
+		}
+	}
+}
+
+func TestAdminRecoverer(t *testing.T) {
+	var received []string
+	admin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost || r.URL.Path != "/dbos-workflow-recovery" {
+			http.NotFound(w, r)
+			return
+		}
+		json.NewDecoder(r.Body).Decode(&received)
+		w.Write([]byte(`["wf-1"]`))
+	}))
+	defer admin.Close()
+
+	config := testConfig()
+	config.AdminTimeout = time.Second
+	recoverer := newAdminRecoverer(config)
+	recoverer.url = admin.URL + "/dbos-workflow-recovery"
+	recovered, err := recoverer.recoverWorkflows(context.Background(), []string{"pod-b"})
+	if err != nil || !slices.Equal(recovered, []string{"wf-1"}) || !slices.Equal(received, []string{"pod-b"}) {
+		t.Errorf("recovered %v, %v with executors %v sent, want wf-1 recovering pod-b", recovered, err, received)
+	}
+
+	recoverer.url = admin.URL + "/missing"
+	if _, err := recoverer.recoverWorkflows(context.Background(), []string{"pod-b"}); err == nil {
+		t.Error("recovering through a failing admin server succeeded")
+	}
+}
+
+func TestMetricsContentNegotiation(t *testing.T) {
+	fake := &fakeDBOS{workflows: queuedWorkflows("q", 4)}
+	metadata := fakeMetadataSource{queues: []autoscale.QueueMetadata{{Name: "q", WorkerConcurrency: 2}}}
+	tests := []struct {
+		accept          string
+		wantContentType string
+	}{
+		{"", "application/json"},
+		{"*/*", "application/json"},
+		{"application/json", "application/json"},
+		{"text/plain", "text/plain"},
+		{"application/openmetrics-text;version=1.0.0,text/plain;version=0.0.4;q=0.5,*/*;q=0.1", "text/plain"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.accept, func(t *testing.T) {
+			header := http.Header{}
+			if tt.accept != "" {
+				header.Set("Accept", tt.accept)
+			}
+			w := serve(t, routerDeps{config: testConfig(), dbosContext: fake, metadata: metadata}, http.MethodGet, "/metrics", header)
+			if w.Code != http.StatusOK {
+				t.Fatalf("status = %d, want 200 (body %s)", w.Code, w.Body)
+			}
+			if contentType := w.Header().Get("Content-Type"); !strings.HasPrefix(contentType, tt.wantContentType) {
+				t.Errorf("Content-Type = %q, want %s", contentType, tt.wantContentType)
+			}
+			if tt.wantContentType != "application/json" && !strings.Contains(w.Body.String(), `dbos_expected_pods{queue="q"} 2`) {
+				t.Errorf("body misses the expected pods gauge:\n%s", w.Body)
+			}
+		})
+	}
+}
+
+func TestEnqueueDryRun(t *testing.T) {
+	fake := &fakeDBOS{}
+	deps := routerDeps{config: testConfig(), dbosContext: fake}
+	w := serve(t, deps, http.MethodGet, "/enqueue/10?validate=1", http.Header{"Idempotency-Key": {"key-1"}})
+	if w.Code != http.StatusOK {
+		t.Fatalf("status = %d, want 200 (body %s)", w.Code, w.Body)
+	}
+	var body map[string]any
+	if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil {
+		t.Fatalf("decoding body %s: %v", w.Body, err)
+	}
+	if body["dry_run"] != true || body["queue"] != "q" || body["duration"] != 10.0 || body["idempotency_key"] != "key-1" {
+		t.Errorf("body = %v, want a dry run of a 10s workflow on q with idempotency key key-1", body)
+	}
+	if len(fake.inputs) != 0 {
+		t.Errorf("started workflows with inputs %v, want none", fake.inputs)
+	}
+
+	// The dry run fails as the real request would
+	assertAPIError(t, serve(t, deps, http.MethodGet, "/enqueue/abc?validate=1", nil), http.StatusBadRequest, ErrCodeInvalidDuration)
+	assertAPIError(t, serve(t, deps, http.MethodGet, "/enqueue/10?validate=1&priority=1", nil), http.StatusBadRequest, ErrCodeInvalidParameter)
+}
+
+func TestEnqueueTimeout(t *testing.T) {
+	block := make(chan struct{})
+	defer close(block)
+	config := testConfig()
+	config.EnqueueTimeout = 20 * time.Millisecond
+	deps := routerDeps{config: config, dbosContext: &fakeDBOS{runBlock: block}}
+
+	assertAPIError(t, serve(t, deps, http.MethodGet, "/enqueue/10", nil), http.StatusGatewayTimeout, ErrCodeEnqueueTimeout)
+	assertAPIError(t, serve(t, deps, http.MethodGet, "/enqueue/fib/10", nil), http.StatusGatewayTimeout, ErrCodeEnqueueTimeout)
+	assertAPIError(t, serveBody(t, deps, http.MethodPost, "/enqueue/batch", nil, strings.NewReader(`{"durations": [1, 2]}`)), http.StatusGatewayTimeout, ErrCodeEnqueueTimeout)
+
+	// A client disconnecting is not answered with an error
+	deps.queues = []dbos.WorkflowQueue{{Name: "q"}}
+	deps.metadata = fakeMetadataSource{}
+	r := newRouter(deps)
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/enqueue/10", nil).WithContext(ctx))
+	if w.Code != statusClientClosedRequest || w.Body.Len() != 0 {
+		t.Errorf("disconnected client: status = %d with body %s, want %d without a body", w.Code, w.Body, statusClientClosedRequest)
+	}
+}
+
+// TestEnqueueRaisesExpectedPods enqueues through the API and scrapes /metrics, with the queue metadata
+// served by the mock admin server
+func TestEnqueueRaisesExpectedPods(t *testing.T) {
+	fixture := filepath.Join(t.TempDir(), "queues.json")
+	if err := os.WriteFile(fixture, []byte(`[{"name": "a", "workerConcurrency": 2}, {"name": "b", "workerConcurrency": 3}]`), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	config := testConfig()
+	config.MinPods = 0
+	config.MockAdminFile = fixture
+	config.AdminRetryAttempts = 1
+	metadata, err := newMetadataSource(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fake := &fakeDBOS{}
+	deps := routerDeps{config: config, dbosContext: fake, queues: []dbos.WorkflowQueue{{Name: "a"}, {Name: "b"}}, metadata: metadata}
+
+	enqueue := func(queue string, n int) {
+		t.Helper()
+		fake.enqueueOn = queue
+		for range n {
+			if w := serve(t, deps, http.MethodGet, "/enqueue/10?queue="+queue, nil); w.Code != http.StatusOK {
+				t.Fatalf("enqueuing on %s: status = %d, want 200 (body %s)", queue, w.Code, w.Body)
+			}
+		}
+	}
+	scrape := func() QueueMetricsResponse {
+		t.Helper()
+		w := serve(t, deps, http.MethodGet, "/metrics", nil)
+		var body QueueMetricsResponse
+		if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil || w.Code != http.StatusOK {
+			t.Fatalf("scraping /metrics: status %d, body %s: %v", w.Code, w.Body, err)
+		}
+		return body
+	}
+
+	if body := scrape(); body.ExpectedPods != 0 {
+		t.Errorf("expected pods before enqueuing = %d, want 0", body.ExpectedPods)
+	}
+
+	enqueue("a", 5)
+	if body := scrape(); body.ExpectedPods != 3 || body.Queues["a"].ExpectedPods != 3 {
+		t.Errorf("after 5 workflows on a queue of concurrency 2: %+v, want 3 expected pods", body)
+	}
+
+	// The most demanding queue sets the total
+	enqueue("b", 10)
+	body := scrape()
+	if body.Queues["a"].ExpectedPods != 3 || body.Queues["b"].ExpectedPods != 4 || body.ExpectedPods != 4 {
+		t.Errorf("after 10 more workflows on a queue of concurrency 3: %+v, want 3 pods for a, 4 for b and 4 in total", body)
+	}
+}
+
+func TestConcurrencyOverride(t *testing.T) {
+	fake := &fakeDBOS{workflows: queuedWorkflows("q", 4)}
+	metadata := fakeMetadataSource{queues: []autoscale.QueueMetadata{{Name: "q", WorkerConcurrency: 2}}}
+	r := newRouter(routerDeps{config: testConfig(), dbosContext: fake, queues: []dbos.WorkflowQueue{{Name: "q"}}, metadata: metadata})
+	do := func(method, target, body string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, httptest.NewRequest(method, target, strings.NewReader(body)))
+		return w
+	}
+	expectedPods := func() int {
+		t.Helper()
+		var body QueueMetricsResponse
+		if err := json.Unmarshal(do(http.MethodGet, "/metrics", "").Body.Bytes(), &body); err != nil {
+			t.Fatalf("decoding /metrics: %v", err)
+		}
+		return body.ExpectedPods
+	}
+
+	if w := do(http.MethodPost, "/queues/q/concurrency", `{"value": 1}`); w.Code != http.StatusOK {
+		t.Fatalf("override: status = %d, want 200 (body %s)", w.Code, w.Body)
+	}
+	if pods := expectedPods(); pods != 4 {
+		t.Errorf("expected pods with a worker concurrency of 1 = %d, want 4", pods)
+	}
+	if w := do(http.MethodDelete, "/queues/q/concurrency", ""); !strings.Contains(w.Body.String(), `"was_overridden":true`) {
+		t.Errorf("reset: body %s, want was_overridden", w.Body)
+	}
+	if pods := expectedPods(); pods != 2 {
+		t.Errorf("expected pods after the reset = %d, want 2", pods)
+	}
+
+	assertAPIError(t, do(http.MethodPost, "/queues/missing/concurrency", `{"value": 1}`), http.StatusNotFound, ErrCodeQueueNotFound)
+	assertAPIError(t, do(http.MethodPost, "/queues/q/concurrency", `{"value": 0}`), http.StatusBadRequest, ErrCodeInvalidBody)
+	assertAPIError(t, do(http.MethodPost, "/queues/q/concurrency", `{}`), http.StatusBadRequest, ErrCodeInvalidBody)
+}
+
+func TestValidateQueues(t *testing.T) {
+	tests := []struct {
+		name    string
+		queues  []QueueConfig
+		wantErr bool
+	}{
+		{"valid", []QueueConfig{{Name: "a"}, {Name: "b", WorkerConcurrency: 2}}, false},
+		{"none", nil, true},
+		{"empty name", []QueueConfig{{Name: ""}}, true},
+		{"duplicate", []QueueConfig{{Name: "a"}, {Name: "a"}}, true},
+		{"negative concurrency", []QueueConfig{{Name: "a", WorkerConcurrency: -1}}, true},
+		{"reserved history", []QueueConfig{{Name: "history"}}, true},
+		{"reserved queue", []QueueConfig{{Name: "a"}, {Name: "queue"}}, true},
+	}
+	for _, tt := range tests {
+		if err := validateQueues(tt.queues); (err != nil) != tt.wantErr {
+			t.Errorf("%s: validateQueues() error = %v, want error %t", tt.name, err, tt.wantErr)
+		}
+	}
+}
+
+func TestLoadConfigDefaultQueue(t *testing.T) {
+	t.Setenv("DBOS_SYSTEM_DATABASE_URL", "postgres://localhost/dbos")
+	t.Setenv("QUEUES", `[{"name": "a"}, {"name": "b"}]`)
+	t.Setenv("DEFAULT_QUEUE_NAME", "b")
+	config, err := loadConfig()
+	if err != nil {
+		t.Fatalf("loadConfig: %v", err)
+	}
+	if config.Queues[0].Name != "b" {
+		t.Errorf("first queue = %s, want the default queue b", config.Queues[0].Name)
+	}
+
+	t.Setenv("DEFAULT_QUEUE_NAME", "c")
+	if _, err := loadConfig(); err == nil || !strings.Contains(err.Error(), "DEFAULT_QUEUE_NAME") {
+		t.Errorf("loadConfig with a default queue outside QUEUES: error = %v, want DEFAULT_QUEUE_NAME rejected", err)
+	}
+}
+
+func TestConfigReload(t *testing.T) {
+	config := testConfig()
+	config.Queues = []QueueConfig{{Name: "q", WorkerConcurrency: 2}}
+	next := config
+	next.MinPods = 5
+	next.Port = 9000
+	next.Queues = []QueueConfig{{Name: "q", WorkerConcurrency: 2, Weight: 2}}
+
+	current := config
+	applied, restart := current.applyLive(next)
+	if !slices.Equal(applied, []string{"min_pods", "queues.weight"}) || !slices.Equal(restart, []string{"port"}) {
+		t.Errorf("applied %v and restart %v, want min_pods and queues.weight applied and port requiring a restart", applied, restart)
+	}
+	if current.MinPods != 5 || current.Port != 0 || current.Queues[0].Weight != 2 {
+		t.Errorf("config after the reload = %+v, want the new MIN_PODS and weight but the old port", current)
+	}
+
+	reloader := newConfigReloader(config, func() (AppConfig, error) { return next, nil })
+	metadata := fakeMetadataSource{queues: []autoscale.QueueMetadata{{Name: "q", WorkerConcurrency: 2}}}
+	deps := routerDeps{config: config, dbosContext: &fakeDBOS{}, metadata: metadata, reloader: reloader}
+	r := newRouter(deps)
+	reloader.reload()
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	if !strings.Contains(w.Body.String(), `"expected_pods":5`) {
+		t.Errorf("/metrics after the reload: body %s, want the new MIN_PODS of 5", w.Body)
+	}
+
+	// The limits read on each request apply to the next ones
+	next.MaxSleepSeconds = 5
+	next.MaxBodyBytes = 8
+	next.EnqueueRateLimit = 1
+	next.EnqueueRateBurst = 1
+	reloader.reload()
+	request := func(method, target, body string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, httptest.NewRequest(method, target, strings.NewReader(body)))
+		return w
+	}
+	assertAPIError(t, request(http.MethodGet, "/enqueue/10", ""), http.StatusBadRequest, ErrCodeInvalidDuration)
+	assertAPIError(t, request(http.MethodPost, "/enqueue", `{"duration_seconds": 1}`), http.StatusRequestEntityTooLarge, ErrCodePayloadTooLarge)
+	assertAPIError(t, request(http.MethodGet, "/enqueue/1", ""), http.StatusTooManyRequests, ErrCodeRateLimited)
+}
+
+func TestEnqueueFetch(t *testing.T) {
+	fake := &fakeDBOS{}
+	deps := routerDeps{config: testConfig(), dbosContext: fake}
+	// An IP address, the host names not resolving without a network
+	w := serve(t, deps, http.MethodGet, "/enqueue/fetch?url=https://93.184.215.14/health", http.Header{"X-Request-Id": {"req-1"}})
+	if w.Code != http.StatusOK {
+		t.Fatalf("status = %d, want 200 (body %s)", w.Code, w.Body)
+	}
+	if len(fake.inputs) != 1 || fake.inputs[0] != (FetchWorkflowInput{URL: "https://93.184.215.14/health", RequestID: "req-1"}) {
+		t.Errorf("started workflows with inputs %v, want a single fetch of https://93.184.215.14/health", fake.inputs)
+	}
+
+	for _, target := range []string{
+		"/enqueue/fetch",
+		"/enqueue/fetch?url=file:///etc/passwd",
+		"/enqueue/fetch?url=example.com",
+		"/enqueue/fetch?url=http://",
+		"/enqueue/fetch?url=http://127.0.0.1:3001/dbos-workflow-recovery",
+		"/enqueue/fetch?url=http://169.254.169.254/latest/meta-data",
+		"/enqueue/fetch?url=http://10.0.0.1/",
+		"/enqueue/fetch?url=http://[::1]/",
+		"/enqueue/fetch?url=http://0.0.0.0/",
+		"/enqueue/fetch?url=http://[::ffff:192.168.0.1]/",
+	} {
+		assertAPIError(t, serve(t, deps, http.MethodGet, target, nil), http.StatusBadRequest, ErrCodeInvalidParameter)
+	}
+
+	// OUTBOUND_ALLOWED_NETWORKS lets the internal networks it names through
+	outboundAllowed = AppConfig{OutboundAllowed: []string{"10.0.0.0/8"}}.outboundNetworks()
+	defer func() { outboundAllowed = nil }()
+	if w := serve(t, deps, http.MethodGet, "/enqueue/fetch?url=http://10.1.2.3/", nil); w.Code != http.StatusOK {
+		t.Errorf("allowed network: status = %d, want 200 (body %s)", w.Code, w.Body)
+	}
+}
+
+func TestOutboundClient(t *testing.T) {
+	redirect := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, "http://169.254.169.254/latest/meta-data", http.StatusFound)
+	}))
+	defer redirect.Close()
+	client := newOutboundClient(time.Second)
+
+	if _, err := client.Get(redirect.URL); err == nil || !strings.Contains(err.Error(), "internal address") {
+		t.Errorf("GET of a loopback server: error = %v, want the internal address refused", err)
+	}
+	outboundAllowed = AppConfig{OutboundAllowed: []string{"127.0.0.0/8"}}.outboundNetworks()
+	defer func() { outboundAllowed = nil }()
+	if _, err := client.Get(redirect.URL); err == nil || !strings.Contains(err.Error(), "169.254.169.254") {
+		t.Errorf("GET redirected to the metadata server: error = %v, want the redirect refused", err)
+	}
+}
+
+func TestPrometheusExpectedPods(t *testing.T) {
+	fake := &fakeDBOS{workflows: append(queuedWorkflows("a", 3), queuedWorkflows("b", 6)...)}
+	metadata := fakeMetadataSource{queues: []autoscale.QueueMetadata{{Name: "a", WorkerConcurrency: 1}, {Name: "b", WorkerConcurrency: 3}}}
+	twoQueues := []dbos.WorkflowQueue{{Name: "a"}, {Name: "b"}}
+	for _, tt := range []struct {
+		mode   string
+		queues []dbos.WorkflowQueue
+		want   []string
+	}{
+		{"labeled", twoQueues, []string{`dbos_expected_pods{queue="a"} 3`, `dbos_expected_pods{queue="b"} 2`}},
+		{"aggregated", twoQueues, []string{"dbos_expected_pods 3\n"}},
+		{"auto", twoQueues, []string{`dbos_expected_pods{queue="a"} 3`}},
+		{"auto", twoQueues[:1], []string{"dbos_expected_pods 3\n"}},
+	} {
+		config := testConfig()
+		config.PromExpectedPods = tt.mode
+		w := serve(t, routerDeps{config: config, dbosContext: fake, queues: tt.queues, metadata: metadata}, http.MethodGet, "/prometheus", nil)
+		for _, want := range tt.want {
+			if !strings.Contains(w.Body.String(), want) {
+				t.Errorf("%s with %d queues: exposition lacks %q", tt.mode, len(tt.queues), want)
+			}
+		}
+	}
+}
+
+func TestLimitConcurrency(t *testing.T) {
+	block := make(chan struct{})
+	config := testConfig()
+	config.MaxConcurrent = 1
+	running := make(chan struct{})
+	r := newRouter(routerDeps{config: config, dbosContext: &fakeDBOS{runBlock: block, running: running}, queues: []dbos.WorkflowQueue{{Name: "q"}}, metadata: fakeMetadataSource{}})
+	do := func(target string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, target, nil))
+		return w
+	}
+
+	// The enqueue holds the only slot until unblocked
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		do("/enqueue/10")
+	}()
+	<-running
+	w := do("/queues")
+	assertAPIError(t, w, http.StatusServiceUnavailable, ErrCodeOverloaded)
+	if w.Header().Get("Retry-After") == "" {
+		t.Error("Retry-After is not set on the 503")
+	}
+	// The probes, scrapes and index are not limited
+	for _, target := range []string{"/healthz", "/metrics", "/metrics/history", "/prometheus", "/"} {
+		if w := do(target); w.Code != http.StatusOK {
+			t.Errorf("%s while saturated: status = %d, want 200 (body %s)", target, w.Code, w.Body)
+		}
+	}
+
+	close(block)
+	<-done
+	if w := do("/queues"); w.Code != http.StatusOK {
+		t.Errorf("/queues once the slot is released: status = %d, want 200 (body %s)", w.Code, w.Body)
+	}
+}
+
+func TestWorkflowStatusNames(t *testing.T) {
+	for _, tt := range []struct {
+		raw  dbos.WorkflowStatusType
+		want string
+	}{
+		{dbos.WorkflowStatusEnqueued, workflowStatusQueued},
+		{dbos.WorkflowStatusPending, workflowStatusRunning},
+		{dbos.WorkflowStatusSuccess, workflowStatusSucceeded},
+		{dbos.WorkflowStatusError, workflowStatusFailed},
+		{dbos.WorkflowStatusMaxRecoveryAttemptsExceeded, workflowStatusFailed},
+		{dbos.WorkflowStatusCancelled, workflowStatusCancelled},
+		{"PAUSED", workflowStatusUnknown},
+	} {
+		response := newWorkflowStatusResponse(dbos.WorkflowStatus{ID: "wf-1", Status: tt.raw})
+		if response.Status != tt.want || response.RawStatus != string(tt.raw) {
+			t.Errorf("%s: status %s with raw status %s, want %s with raw status %s", tt.raw, response.Status, response.RawStatus, tt.want, tt.raw)
+		}
+	}
+
+	statuses, ok := workflowStatusFilter(workflowStatusFailed)
+	if !ok || !slices.Equal(statuses, []dbos.WorkflowStatusType{dbos.WorkflowStatusError, dbos.WorkflowStatusMaxRecoveryAttemptsExceeded}) {
+		t.Errorf("FAILED filter = %v, want ERROR and MAX_RECOVERY_ATTEMPTS_EXCEEDED", statuses)
+	}
+	if statuses, ok := workflowStatusFilter(string(dbos.WorkflowStatusSuccess)); !ok || !slices.Equal(statuses, []dbos.WorkflowStatusType{dbos.WorkflowStatusSuccess}) {
+		t.Errorf("SUCCESS filter = %v, want SUCCESS", statuses)
+	}
+	if _, ok := workflowStatusFilter("DONE"); ok {
+		t.Error("DONE filter accepted, want it rejected")
+	}
+}
+
+func TestEnqueueCounters(t *testing.T) {
+	config := testConfig()
+	metadata := fakeMetadataSource{queues: []autoscale.QueueMetadata{{Name: "counted-ok"}, {Name: "counted-err"}}}
+	serve(t, routerDeps{config: config, dbosContext: &fakeDBOS{}, queues: []dbos.WorkflowQueue{{Name: "counted-ok"}}, metadata: metadata}, http.MethodGet, "/enqueue/1", nil)
+	serve(t, routerDeps{config: config, dbosContext: &fakeDBOS{runErr: errors.New("boom")}, queues: []dbos.WorkflowQueue{{Name: "counted-err"}}, metadata: metadata}, http.MethodGet, "/enqueue/1", nil)
+
+	scrapeErrorsBefore := testutil.ToFloat64(scrapeErrors)
+	failing := fakeMetadataSource{err: errors.New("admin server down")}
+	serve(t, routerDeps{config: config, dbosContext: &fakeDBOS{}, queues: []dbos.WorkflowQueue{{Name: "counted-ok"}}, metadata: failing}, http.MethodGet, "/prometheus", nil)
+	w := serve(t, routerDeps{config: config, dbosContext: &fakeDBOS{}, queues: []dbos.WorkflowQueue{{Name: "counted-ok"}}, metadata: metadata}, http.MethodGet, "/prometheus", nil)
+	for _, want := range []string{
+		`dbos_enqueue_total{queue="counted-ok"} 1`,
+		`dbos_enqueue_total{queue="counted-err"} 1`,
+		`dbos_enqueue_errors_total{queue="counted-err"} 1`,
+		"dbos_scrape_errors_total ",
+	} {
+		if !strings.Contains(w.Body.String(), want) {
+			t.Errorf("exposition lacks %q:\n%s", want, w.Body)
+		}
+	}
+	if strings.Contains(w.Body.String(), `dbos_enqueue_errors_total{queue="counted-ok"}`) {
+		t.Error("the successful enqueue is counted as an error")
+	}
+	if got := testutil.ToFloat64(scrapeErrors) - scrapeErrorsBefore; got < 1 {
+		t.Errorf("scrape errors rose by %v, want at least 1", got)
+	}
+}
+
+func TestMaxQueueDepth(t *testing.T) {
+	metadata := fakeMetadataSource{queues: []autoscale.QueueMetadata{{Name: "q", WorkerConcurrency: 1}}}
+	queues := []dbos.WorkflowQueue{{Name: "q"}}
+	for _, tt := range []struct {
+		maxDepth   int
+		wantStatus int
+	}{
+		{0, http.StatusOK},
+		{4, http.StatusOK},
+		{3, http.StatusTooManyRequests},
+	} {
+		config := testConfig()
+		config.MaxQueueDepth = tt.maxDepth
+		fake := &fakeDBOS{workflows: queuedWorkflows("q", 3)}
+		w := serve(t, routerDeps{config: config, dbosContext: fake, queues: queues, metadata: metadata}, http.MethodGet, "/enqueue/1", nil)
+		if tt.wantStatus == http.StatusOK {
+			if w.Code != http.StatusOK {
+				t.Errorf("MAX_QUEUE_DEPTH=%d: status = %d, want 200 (body %s)", tt.maxDepth, w.Code, w.Body)
+			}
+			continue
+		}
+		assertAPIError(t, w, http.StatusTooManyRequests, ErrCodeQueueFull)
+		var body struct {
+			Details struct {
+				Depth int `json:"depth"`
+				Limit int `json:"limit"`
+			} `json:"details"`
+		}
+		if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil {
+			t.Fatal(err)
+		}
+		if body.Details.Depth != 3 || body.Details.Limit != tt.maxDepth {
+			t.Errorf("details = %+v, want depth 3 and limit %d", body.Details, tt.maxDepth)
+		}
+		if len(fake.inputs) != 0 {
+			t.Errorf("the rejected workflow was enqueued: %v", fake.inputs)
+		}
+	}
+
+	// The depths cannot be computed: the enqueue is admitted
+	config := testConfig()
+	config.MaxQueueDepth = 1
+	failing := fakeMetadataSource{err: errors.New("admin server down")}
+	if w := serve(t, routerDeps{config: config, dbosContext: &fakeDBOS{}, queues: queues, metadata: failing}, http.MethodGet, "/enqueue/1", nil); w.Code != http.StatusOK {
+		t.Errorf("without metrics: status = %d, want 200 (body %s)", w.Code, w.Body)
+	}
+
+	// A computation hanging on the database is given up after ENQUEUE_TIMEOUT, admitting the enqueue
+	config.EnqueueTimeout = 20 * time.Millisecond
+	hanging := newBackpressure(func(ctx context.Context) (map[string]autoscale.QueueMetric, error) {
+		<-ctx.Done()
+		return nil, ctx.Err()
+	}, newLiveConfig(config))
+	c, _ := gin.CreateTestContext(httptest.NewRecorder())
+	c.Request = httptest.NewRequest(http.MethodGet, "/enqueue/1", nil)
+	start := time.Now()
+	if !hanging.admit(c, "q") {
+		t.Error("hanging computation: the enqueue was rejected, want it admitted")
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("hanging computation: admitted after %s, want within ENQUEUE_TIMEOUT", elapsed)
+	}
+}
+
+func TestEncodeResponses(t *testing.T) {
+	config := testConfig()
+	config.GzipMinBytes = 256
+	deps := routerDeps{config: config, dbosContext: &fakeDBOS{workflows: queuedWorkflows("q", 20)}}
+	gzipped := http.Header{"Accept-Encoding": {"gzip, deflate"}}
+
+	// gunzip returns the decompressed body, or fails when the response is not gzipped
+	gunzip := func(w *httptest.ResponseRecorder) []byte {
+		t.Helper()
+		if got := w.Header().Get("Content-Encoding"); got != "gzip" {
+			t.Fatalf("Content-Encoding = %q, want gzip", got)
+		}
+		reader, err := gzip.NewReader(w.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, err := io.ReadAll(reader)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return body
+	}
+
+	w := serve(t, deps, http.MethodGet, "/workflows", gzipped)
+	if !json.Valid(gunzip(w)) {
+		t.Error("the gzipped /workflows response is not JSON")
+	}
+	if w := serve(t, deps, http.MethodGet, "/workflows", nil); w.Header().Get("Content-Encoding") != "" || !json.Valid(w.Body.Bytes()) {
+		t.Errorf("/workflows without Accept-Encoding: Content-Encoding %q, body %s", w.Header().Get("Content-Encoding"), w.Body)
+	}
+	if w := serve(t, deps, http.MethodGet, "/workflows", http.Header{"Accept-Encoding": {"gzip;q=0"}}); w.Header().Get("Content-Encoding") != "" {
+		t.Error("/workflows is gzipped although the client refuses gzip")
+	}
+	if w := serve(t, deps, http.MethodGet, "/healthz", gzipped); w.Header().Get("Content-Encoding") != "" || w.Code != http.StatusOK {
+		t.Errorf("tiny /healthz response: status %d, Content-Encoding %q, want an uncompressed 200", w.Code, w.Header().Get("Content-Encoding"))
+	}
+
+	// /prometheus compresses its own exposition, which must not be gzipped twice
+	w = serve(t, routerDeps{config: config, dbosContext: &fakeDBOS{}}, http.MethodGet, "/prometheus", gzipped)
+	if !strings.Contains(string(gunzip(w)), "go_goroutines") {
+		t.Error("the gzipped /prometheus exposition is not readable")
+	}
+
+	w = serve(t, deps, http.MethodGet, "/healthz?pretty=1", nil)
+	if !strings.Contains(w.Body.String(), "{\n  \"") || !json.Valid(w.Body.Bytes()) {
+		t.Errorf("?pretty=1 body is not indented JSON: %s", w.Body)
+	}
+	if pretty := gunzip(serve(t, deps, http.MethodGet, "/workflows?pretty=1", gzipped)); !strings.Contains(string(pretty), "\n  ") {
+		t.Errorf("gzipped ?pretty=1 body is not indented: %s", pretty)
+	}
+}
+
+func TestIndex(t *testing.T) {
+	config := testConfig()
+	config.APIToken = "secret"
+	w := serve(t, routerDeps{config: config, dbosContext: &fakeDBOS{}}, http.MethodGet, "/", nil)
+	if w.Code != http.StatusOK {
+		t.Fatalf("status = %d, want 200 without a token (body %s)", w.Code, w.Body)
+	}
+	var body IndexResponse
+	if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil {
+		t.Fatalf("decoding body %s: %v", w.Body, err)
+	}
+	if body.AppName != appName {
+		t.Errorf("app_name = %q, want %q", body.AppName, appName)
+	}
+	for _, want := range []string{"GET /", "GET /healthz", "GET /enqueue/:duration", "POST /enqueue", "GET /metrics"} {
+		if !slices.Contains(body.Endpoints, want) {
+			t.Errorf("endpoints %v lack %q", body.Endpoints, want)
+		}
+	}
+	if body.Endpoints[0] != "GET /" {
+		t.Errorf("endpoints %v do not start with GET /", body.Endpoints)
+	}
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+const (
+	// serviceAccountDir holds the credentials Kubernetes mounts in every pod of a service account
+	serviceAccountDir = "/var/run/secrets/kubernetes.io/serviceaccount"
+	// scaledObjectTimeout bounds the request registering the ScaledObject
+	scaledObjectTimeout = 10 * time.Second
+	// defaultMaxReplicas is the maxReplicaCount of the registered ScaledObject when MAX_PODS is unlimited
+	defaultMaxReplicas = 100
+)
+
+// errScaledObjectForbidden is returned when the service account of the pod may not manage ScaledObjects
+var errScaledObjectForbidden = errors.New("the service account may not manage ScaledObjects")
+
+// scaledObject returns the KEDA ScaledObject scaling the deployment on the expected pods of its /metrics,
+// reached through the Service of the same name
+func scaledObject(config AppConfig, namespace string) map[string]any {
+	scheme := "http"
+	if config.TLSCertFile != "" {
+		scheme = "https"
+	}
+	maxReplicas := config.MaxPods
+	if maxReplicas == 0 {
+		maxReplicas = defaultMaxReplicas
+	}
+	return map[string]any{
+		"apiVersion": "keda.sh/v1alpha1",
+		"kind":       "ScaledObject",
+		"metadata": map[string]any{
+			"name":      config.DeploymentName + "-scaledobject",
+			"namespace": namespace,
+		},
+		"spec": map[string]any{
+			"scaleTargetRef":  map[string]any{"name": config.DeploymentName},
+			"minReplicaCount": config.MinPods,
+			"maxReplicaCount": maxReplicas,
+			"triggers": []any{map[string]any{
+				"type": "metrics-api",
+				"metadata": map[string]any{
+					"url":           fmt.Sprintf("%s://%s.%s.svc.cluster.local:%d/metrics", scheme, config.DeploymentName, namespace, config.Port),
+					"valueLocation": "expected_pods",
+					"targetValue":   "1", // expected_pods already is the number of replicas
+				},
+			}},
+		},
+	}
+}
+
+// registerScaledObject creates or updates the ScaledObject of the deployment with a server-side apply,
+// authenticating to the Kubernetes API with the service account of the pod
+func registerScaledObject(ctx context.Context, config AppConfig) error {
+	host, port := os.Getenv("KUBERNETES_SERVICE_HOST"), os.Getenv("KUBERNETES_SERVICE_PORT")
+	if host == "" || port == "" {
+		return errors.New("not running in a Kubernetes cluster: KUBERNETES_SERVICE_HOST is not set")
+	}
+	token, err := os.ReadFile(filepath.Join(serviceAccountDir, "token"))
+	if err != nil {
+		return fmt.Errorf("reading the service account token: %w", err)
+	}
+	caCert, err := os.ReadFile(filepath.Join(serviceAccountDir, "ca.crt"))
+	if err != nil {
+		return fmt.Errorf("reading the cluster CA: %w", err)
+	}
+	roots := x509.NewCertPool()
+	if !roots.AppendCertsFromPEM(caCert) {
+		return errors.New("invalid cluster CA certificate")
+	}
+	namespace := config.Namespace
+	if namespace == "" {
+		data, err := os.ReadFile(filepath.Join(serviceAccountDir, "namespace"))
+		if err != nil {
+			return fmt.Errorf("reading the namespace of the pod, set POD_NAMESPACE: %w", err)
+		}
+		namespace = strings.TrimSpace(string(data))
+	}
+
+	// JSON being valid YAML, the object is sent as an apply patch
+	body, err := json.Marshal(scaledObject(config, namespace))
+	if err != nil {
+		return err
+	}
+	target := url.URL{
+		Scheme:   "https",
+		Host:     net.JoinHostPort(host, port),
+		Path:     fmt.Sprintf("/apis/keda.sh/v1alpha1/namespaces/%s/scaledobjects/%s-scaledobject", namespace, config.DeploymentName),
+		RawQuery: url.Values{"fieldManager": {appName}, "force": {"true"}}.Encode(),
+	}
+	request, err := http.NewRequestWithContext(ctx, http.MethodPatch, target.String(), bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	request.Header.Set("Content-Type", "application/apply-patch+yaml")
+	request.Header.Set("Authorization", "Bearer "+strings.TrimSpace(string(token)))
+	client := &http.Client{
+		Timeout:   scaledObjectTimeout,
+		Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: roots}},
+	}
+	response, err := client.Do(request)
+	if err != nil {
+		return fmt.Errorf("applying the ScaledObject: %w", err)
+	}
+	defer response.Body.Close()
+	message, _ := io.ReadAll(io.LimitReader(response.Body, 4096))
+	switch {
+	case response.StatusCode == http.StatusForbidden:
+		return fmt.Errorf("%w: %s", errScaledObjectForbidden, message)
+	case response.StatusCode == http.StatusNotFound:
+		return fmt.Errorf("the ScaledObject resource is not found, is KEDA installed? %s", message)
+	case response.StatusCode >= 300:
+		return fmt.Errorf("applying the ScaledObject: unexpected status %s: %s", response.Status, message)
+	}
+	slog.Info("Registered the KEDA ScaledObject", "namespace", namespace, "name", config.DeploymentName+"-scaledobject")
+	return nil
+}
@@ -0,0 +1,33 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"time"
+
+	"github.com/dbos-inc/dbos-transact-golang/dbos"
+	"github.com/robfig/cron/v3"
+)
+
+// startScheduler runs QueueDepthReportWorkflow on the cron schedule while this pod is the leader.
+// DBOS's own scheduler fires on every pod and cannot be turned off at runtime, so the schedule runs
+// on a cron of its own. The workflow ID derives from the scheduled time, so that a tick is reported
+// once even when the leadership changes over it. It returns a function stopping the scheduler.
+func startScheduler(dbosContext dbos.DBOSContext, schedule string, leader *leaderElector) (func(), error) {
+	scheduler := cron.New(cron.WithSeconds())
+	_, err := scheduler.AddFunc(schedule, func() {
+		if !leader.isLeader() {
+			return
+		}
+		scheduledTime := time.Now().Truncate(time.Second)
+		workflowID := fmt.Sprintf("sched-QueueDepthReportWorkflow-%d", scheduledTime.Unix())
+		if _, err := dbos.RunWorkflow(dbosContext, QueueDepthReportWorkflow, scheduledTime, dbos.WithWorkflowID(workflowID)); err != nil {
+			slog.Error("Running the scheduled workflow failed", "workflow_id", workflowID, "error", err)
+		}
+	})
+	if err != nil {
+		return nil, fmt.Errorf("scheduling QueueDepthReportWorkflow: %w", err)
+	}
+	scheduler.Start()
+	return func() { <-scheduler.Stop().Done() }, nil
+}
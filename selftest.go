@@ -0,0 +1,29 @@
+package main
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/dbos-inc/dbos-transact-golang/dbos"
+)
+
+// selfTestTimeout bounds how long the self-test waits for its workflow to complete
+const selfTestTimeout = time.Minute
+
+// runSelfTest enqueues a one second sleep workflow on the queue and waits for its result, printing
+// the outcome. It returns the process exit code: 0 if the workflow succeeded, 1 otherwise.
+func runSelfTest(dbosContext dbos.DBOSContext, queue dbos.WorkflowQueue) int {
+	start := time.Now()
+	handle, err := dbos.RunWorkflow(dbosContext, SleepWorkflow, SleepWorkflowInput{DurationSeconds: 1}, dbos.WithQueue(queue.Name))
+	if err != nil {
+		fmt.Printf("selftest FAILED: enqueuing on queue %s: %v\n", queue.Name, err)
+		return 1
+	}
+	result, err := handle.GetResult(dbos.WithHandleTimeout(selfTestTimeout))
+	if err != nil {
+		fmt.Printf("selftest FAILED: workflow %s: %v\n", handle.GetWorkflowID(), err)
+		return 1
+	}
+	fmt.Printf("selftest OK: workflow %s on queue %s returned %q in %s\n", handle.GetWorkflowID(), queue.Name, result, time.Since(start).Round(time.Millisecond))
+	return 0
+}
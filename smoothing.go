@@ -0,0 +1,80 @@
+package main
+
+import (
+	"math"
+	"sync"
+	"time"
+)
+
+// ewmaTolerance is the fraction of a pod dropped before rounding a decreasing moving average up, so that
+// the average settles on the new estimate once the backlog has shrunk instead of approaching it forever.
+// A rising average is rounded up as is, never under-provisioning a growing backlog.
+const ewmaTolerance = 0.05
+
+// podSmoother smooths the pod estimates across scrapes, so that a scrape racing an enqueue or a short
+// backlog spike does not make the deployment flap. Estimates are tracked per key, e.g. per queue.
+//
+// With a smoothing factor, the estimate is an exponentially weighted moving average of the observed
+// ones, rounded up. With a window, it is the highest estimate observed over the window: increases apply
+// at once, decreases once every higher estimate has left the window. Both trade responsiveness for
+// stability; the window applies to the moving average when both are set. They are passed on each
+// estimate, so that a reload changes them without losing the estimates observed so far.
+type podSmoother struct {
+	mu       sync.Mutex
+	samples  map[string][]podSample
+	averages map[string]float64
+}
+
+// podSample is a pod estimate observed at a point in time
+type podSample struct {
+	at   time.Time
+	pods int
+}
+
+// newPodSmoother returns a smoother without any estimate observed
+func newPodSmoother() *podSmoother {
+	return &podSmoother{
+		samples:  make(map[string][]podSample),
+		averages: make(map[string]float64),
+	}
+}
+
+// smooth records the estimate observed now under key and returns the estimate smoothed over the window
+// with the smoothing factor alpha, the weight of the latest estimate in the moving average. The estimate
+// is returned unchanged when both are 0, and the state of a disabled smoothing is dropped.
+func (s *podSmoother) smooth(key string, pods int, window time.Duration, alpha float64, now time.Time) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if alpha > 0 {
+		average, ok := s.averages[key]
+		if !ok {
+			average = float64(pods)
+		}
+		average = alpha*float64(pods) + (1-alpha)*average
+		s.averages[key] = average
+		if float64(pods) < average {
+			pods = int(math.Ceil(average - ewmaTolerance))
+		} else {
+			pods = int(math.Ceil(average))
+		}
+	} else {
+		delete(s.averages, key)
+	}
+	if window <= 0 {
+		delete(s.samples, key)
+		return pods
+	}
+
+	samples := s.samples[key]
+	kept := samples[:0]
+	highest := pods
+	for _, sample := range samples {
+		if now.Sub(sample.at) < window {
+			kept = append(kept, sample)
+			highest = max(highest, sample.pods)
+		}
+	}
+	s.samples[key] = append(kept, podSample{at: now, pods: pods})
+	return highest
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/dbos-inc/dbos-transact-golang/dbos"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+const (
+	// systemDBSchema is the schema of the DBOS system database tables, DBOS's default
+	systemDBSchema = "dbos"
+	// systemDBMaxConns bounds the connections opened for the statements DBOS has no API for,
+	// on top of those of the DBOS pool
+	systemDBMaxConns = 2
+)
+
+// systemDB runs against the DBOS system database the statements DBOS has no API for
+type systemDB struct {
+	pool *pgxpool.Pool
+}
+
+// openSystemDB returns a pool of connections to the system database. Connections are opened on first use.
+func openSystemDB(ctx context.Context, databaseURL string) (*systemDB, error) {
+	poolConfig, err := pgxpool.ParseConfig(databaseURL)
+	if err != nil {
+		return nil, fmt.Errorf("parsing the system database URL: %w", err)
+	}
+	poolConfig.MaxConns = systemDBMaxConns
+	pool, err := pgxpool.NewWithConfig(ctx, poolConfig)
+	if err != nil {
+		return nil, fmt.Errorf("opening the system database pool: %w", err)
+	}
+	return &systemDB{pool: pool}, nil
+}
+
+// connConfig returns the configuration of the pool's connections, to open connections outside of it
+func (db *systemDB) connConfig() *pgx.ConnConfig {
+	return db.pool.Config().ConnConfig.Copy()
+}
+
+// close closes the connections of the pool
+func (db *systemDB) close() {
+	db.pool.Close()
+}
+
+// purgeCompletedWorkflows deletes the workflows created before the cutoff that will not run anymore,
+// along with their steps, events and streams, and returns how many were deleted. It runs the statement
+// of the DBOS garbage collection, which the DBOS Go library does not expose.
+func (db *systemDB) purgeCompletedWorkflows(ctx context.Context, cutoff time.Time) (int64, error) {
+	query := fmt.Sprintf(`DELETE FROM %s.workflow_status WHERE created_at < $1 AND status NOT IN ($2, $3)`, pgx.Identifier{systemDBSchema}.Sanitize())
+	tag, err := db.pool.Exec(ctx, query, cutoff.UnixMilli(), dbos.WorkflowStatusPending, dbos.WorkflowStatusEnqueued)
+	if err != nil {
+		return 0, err
+	}
+	return tag.RowsAffected(), nil
+}
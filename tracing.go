@@ -0,0 +1,51 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"os"
+
+	"github.com/gin-gonic/gin"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// tracer creates the spans of the application, a no-op unless setupTracing installed an exporter
+var tracer = otel.Tracer("kubernetes-integration")
+
+// setupTracing exports traces over OTLP/HTTP when OTEL_EXPORTER_OTLP_ENDPOINT (or its traces-specific
+// variant) is set, leaving the global no-op tracer provider in place otherwise. The exporter reads the
+// standard OTEL_EXPORTER_OTLP_* env vars. The returned function flushes the pending spans.
+func setupTracing(ctx context.Context) (func(context.Context) error, error) {
+	if os.Getenv("OTEL_EXPORTER_OTLP_ENDPOINT") == "" && os.Getenv("OTEL_EXPORTER_OTLP_TRACES_ENDPOINT") == "" {
+		return func(context.Context) error { return nil }, nil
+	}
+
+	exporter, err := otlptracehttp.New(ctx)
+	if err != nil {
+		return nil, err
+	}
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(resource.NewSchemaless(semconv.ServiceName(appName))),
+	)
+	otel.SetTracerProvider(provider)
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{}))
+	slog.Info("OpenTelemetry tracing enabled")
+	return provider.Shutdown, nil
+}
+
+// logEnqueued logs an enqueued workflow and attaches its ID to the request span
+func logEnqueued(c *gin.Context, workflowID, queueName string) {
+	trace.SpanFromContext(c.Request.Context()).SetAttributes(
+		attribute.String("dbos.workflow_id", workflowID),
+		attribute.String("dbos.queue", queueName),
+	)
+	slog.Info("Workflow enqueued", "request_id", requestID(c), "workflow_id", workflowID, "queue", queueName)
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"sync"
+	"time"
+
+	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
+)
+
+// ScaleEvent is the payload POSTed to the webhook when the expected pods rise above the threshold
+type ScaleEvent struct {
+	Event        string    `json:"event"` // Always "expected_pods_above_threshold"
+	ExpectedPods int       `json:"expected_pods"`
+	Threshold    int       `json:"threshold"`
+	Timestamp    time.Time `json:"timestamp"`
+}
+
+// scaleWebhook notifies a URL when an observed pod estimate crosses above the threshold. It fires once
+// per crossing: estimates staying above the threshold are ignored until one falls back to or below it.
+type scaleWebhook struct {
+	url    string
+	client *http.Client
+
+	mu        sync.Mutex
+	threshold int
+	above     bool // Whether the last observed estimate was above the threshold
+}
+
+// newScaleWebhook returns a webhook posting to url, or nil when url is empty
+func newScaleWebhook(url string, threshold int, timeout time.Duration) *scaleWebhook {
+	if url == "" {
+		return nil
+	}
+	return &scaleWebhook{
+		url:       url,
+		threshold: threshold,
+		client:    &http.Client{Timeout: timeout, Transport: otelhttp.NewTransport(http.DefaultTransport)},
+	}
+}
+
+// observe records a pod estimate, notifying the webhook in the background if it crosses the threshold.
+// It does nothing on a nil webhook.
+func (w *scaleWebhook) observe(expectedPods int) {
+	if w == nil {
+		return
+	}
+	w.mu.Lock()
+	threshold := w.threshold
+	crossed := !w.above && expectedPods > threshold
+	w.above = expectedPods > threshold
+	w.mu.Unlock()
+
+	if crossed {
+		go w.send(ScaleEvent{
+			Event:        "expected_pods_above_threshold",
+			ExpectedPods: expectedPods,
+			Threshold:    threshold,
+			Timestamp:    time.Now(),
+		})
+	}
+}
+
+// setThreshold replaces the threshold, the next estimate above it firing the webhook if the last one
+// was not. It does nothing on a nil webhook.
+func (w *scaleWebhook) setThreshold(threshold int) {
+	if w == nil {
+		return
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.threshold = threshold
+}
+
+// send POSTs the event, logging failures since nobody waits on the result
+func (w *scaleWebhook) send(event ScaleEvent) {
+	body, err := json.Marshal(event)
+	if err != nil {
+		slog.Error("Encoding scale event failed", "error", err)
+		return
+	}
+	resp, err := w.client.Post(w.url, "application/json", bytes.NewReader(body))
+	if err == nil {
+		resp.Body.Close()
+		if resp.StatusCode >= 300 {
+			err = fmt.Errorf("unexpected status %s", resp.Status)
+		}
+	}
+	if err != nil {
+		slog.Warn("Notifying the scale webhook failed", "expected_pods", event.ExpectedPods, "error", err)
+		return
+	}
+	slog.Info("Notified the scale webhook", "expected_pods", event.ExpectedPods, "threshold", event.Threshold)
+}
@@ -0,0 +1,272 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/dbos-inc/dbos-transact-golang/dbos"
+)
+
+// SleepWorkflowInput defines the input for the sleep workflow
+type SleepWorkflowInput struct {
+	DurationSeconds int    `json:"duration_seconds"`
+	DurationMillis  int    `json:"duration_millis,omitempty"` // Takes precedence over DurationSeconds when set
+	CallbackURL     string `json:"callback_url,omitempty"`    // POSTed a CallbackEvent once the workflow has slept, if set
+	RequestID       string `json:"request_id,omitempty"`      // X-Request-ID of the request that enqueued the workflow
+}
+
+// validate checks that the input sleeps for a positive duration of at most maxSeconds
+func (input SleepWorkflowInput) validate(maxSeconds int) error {
+	if input.DurationSeconds <= 0 && input.DurationMillis <= 0 {
+		return fmt.Errorf("duration_seconds %d is not positive", input.DurationSeconds)
+	}
+	if input.DurationSeconds < 0 || input.DurationSeconds > maxSeconds {
+		return fmt.Errorf("duration_seconds %d is not between 0 and %d", input.DurationSeconds, maxSeconds)
+	}
+	if input.DurationMillis < 0 || input.DurationMillis > maxSeconds*1000 {
+		return fmt.Errorf("duration_millis %d is not between 0 and %d", input.DurationMillis, maxSeconds*1000)
+	}
+	return nil
+}
+
+// CallbackEvent is the payload POSTed to the callback URL of a sleep workflow once it has slept
+type CallbackEvent struct {
+	Event       string    `json:"event"` // Always "workflow_completed"
+	WorkflowID  string    `json:"workflow_id"`
+	Status      string    `json:"status"` // Always SUCCEEDED, a workflow failing or cancelled before it slept not notifying
+	Output      string    `json:"output"`
+	CompletedAt time.Time `json:"completed_at"`
+}
+
+// FibonacciWorkflowInput defines the input for the Fibonacci workflow
+type FibonacciWorkflowInput struct {
+	N         int    `json:"n"`
+	RequestID string `json:"request_id,omitempty"` // X-Request-ID of the request that enqueued the workflow
+}
+
+// MultiStepWorkflowInput defines the input for the multi-step workflow
+type MultiStepWorkflowInput struct {
+	StepSeconds      int    `json:"step_seconds"`
+	FailFirstAttempt bool   `json:"fail_first_attempt"`   // Makes the second step fail once before being retried
+	RequestID        string `json:"request_id,omitempty"` // X-Request-ID of the request that enqueued the workflow
+}
+
+// FetchWorkflowInput defines the input for the fetch workflow
+type FetchWorkflowInput struct {
+	URL       string `json:"url"`
+	RequestID string `json:"request_id,omitempty"` // X-Request-ID of the request that enqueued the workflow
+}
+
+// validate checks that the input fetches an absolute http or https URL of a host that is not internal
+func (input FetchWorkflowInput) validate(ctx context.Context) error {
+	return validateOutboundURL(ctx, "url", input.URL)
+}
+
+// validateHTTPURL checks that the value of the named field is an absolute http or https URL
+func validateHTTPURL(name, value string) error {
+	u, err := url.Parse(value)
+	if err != nil {
+		return fmt.Errorf("%s %q is not a valid URL: %w", name, value, err)
+	}
+	if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("%s %q is not an absolute http or https URL", name, value)
+	}
+	return nil
+}
+
+// fetchTimeout bounds a single attempt of the HTTP request of FetchWorkflow
+const fetchTimeout = 30 * time.Second
+
+// fetchClient sends the requests of FetchWorkflow, refusing the internal addresses
+var fetchClient = newOutboundClient(fetchTimeout)
+
+const (
+	// callbackTimeout bounds a single attempt of the callback notification of SleepWorkflow
+	callbackTimeout = 10 * time.Second
+	// callbackMaxRetries bounds the attempts of the callback notification, after the first one
+	callbackMaxRetries = 4
+)
+
+// callbackClient sends the callback notifications of SleepWorkflow, refusing the internal addresses
+var callbackClient = newOutboundClient(callbackTimeout)
+
+// multiStepCount is the number of sequential steps run by MultiStepWorkflow
+const multiStepCount = 3
+
+// maxFibonacciN bounds the input of the Fibonacci workflow, whose cost grows exponentially with n
+const maxFibonacciN = 45
+
+// SleepWorkflow sleeps for the configured duration, then notifies the callback URL if there is one.
+// A workflow enqueued with a timeout stops sleeping at its deadline, when DBOS cancels it.
+func SleepWorkflow(ctx dbos.DBOSContext, input SleepWorkflowInput) (string, error) {
+	duration := time.Duration(input.DurationSeconds) * time.Second
+	if input.DurationMillis > 0 {
+		duration = time.Duration(input.DurationMillis) * time.Millisecond
+	}
+	// dbos.Sleep cannot be interrupted, so it only sleeps until the deadline
+	deadline, hasDeadline := ctx.Deadline()
+	if hasDeadline && time.Until(deadline) < duration {
+		dbos.Sleep(ctx, max(time.Until(deadline), 0))
+		<-ctx.Done()
+		return "", fmt.Errorf("workflow timed out after sleeping until its deadline: %w", context.Cause(ctx))
+	}
+	dbos.Sleep(ctx, duration)
+	output := fmt.Sprintf("Slept for %d seconds", input.DurationSeconds)
+	if input.DurationMillis > 0 {
+		output = fmt.Sprintf("Slept for %d milliseconds", input.DurationMillis)
+	}
+	if input.CallbackURL != "" {
+		notifyCallback(ctx, input.CallbackURL, output)
+	}
+	return output, nil
+}
+
+// notifyCallback POSTs the completion of the workflow to the callback URL in a durable step. Once the
+// step completes, a workflow recovered after a crash does not notify again; one that crashed during the
+// step notifies again, so callbacks may be received more than once. A callback still failing after
+// callbackMaxRetries retries is given up on: the workflow keeps its output and a warning is logged.
+func notifyCallback(ctx dbos.DBOSContext, callbackURL, output string) {
+	workflowID, err := dbos.GetWorkflowID(ctx)
+	if err != nil {
+		slog.Warn("Notifying the callback failed", "callback_url", callbackURL, "error", err)
+		return
+	}
+	_, err = dbos.RunAsStep(ctx, func(stepCtx context.Context) (int, error) {
+		body, err := json.Marshal(CallbackEvent{
+			Event:       "workflow_completed",
+			WorkflowID:  workflowID,
+			Status:      workflowStatusSucceeded,
+			Output:      output,
+			CompletedAt: time.Now(),
+		})
+		if err != nil {
+			return 0, err
+		}
+		request, err := http.NewRequestWithContext(stepCtx, http.MethodPost, callbackURL, bytes.NewReader(body))
+		if err != nil {
+			return 0, err
+		}
+		request.Header.Set("Content-Type", "application/json")
+		response, err := callbackClient.Do(request)
+		if err != nil {
+			return 0, err
+		}
+		defer response.Body.Close()
+		io.Copy(io.Discard, response.Body)
+		if response.StatusCode >= 300 {
+			return 0, fmt.Errorf("unexpected status %s", response.Status)
+		}
+		return response.StatusCode, nil
+	}, dbos.WithStepName("callback"), dbos.WithStepMaxRetries(callbackMaxRetries))
+	if err != nil {
+		slog.Warn("Notifying the callback failed", "workflow_id", workflowID, "callback_url", callbackURL, "error", err)
+		return
+	}
+	slog.Info("Notified the callback", "workflow_id", workflowID, "callback_url", callbackURL)
+}
+
+// FibonacciWorkflow computes the n-th Fibonacci number with the naive recursive algorithm,
+// keeping a worker busy on CPU rather than idling like SleepWorkflow
+func FibonacciWorkflow(ctx dbos.DBOSContext, input FibonacciWorkflowInput) (string, error) {
+	result, err := dbos.RunAsStep(ctx, func(context.Context) (int, error) {
+		return fibonacci(input.N), nil
+	}, dbos.WithStepName("fibonacci"))
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("fib(%d) = %d", input.N, result), nil
+}
+
+// FetchWorkflow GETs the URL in a durable step and returns the response status code. Once the step
+// completes, its result is checkpointed: a workflow recovered after a crash returns the recorded status
+// code without sending the request again. Failed requests are retried, but any status code is a result.
+func FetchWorkflow(ctx dbos.DBOSContext, input FetchWorkflowInput) (int, error) {
+	return dbos.RunAsStep(ctx, func(stepCtx context.Context) (int, error) {
+		request, err := http.NewRequestWithContext(stepCtx, http.MethodGet, input.URL, nil)
+		if err != nil {
+			return 0, err
+		}
+		response, err := fetchClient.Do(request)
+		if err != nil {
+			return 0, err
+		}
+		defer response.Body.Close()
+		io.Copy(io.Discard, response.Body)
+		return response.StatusCode, nil
+	}, dbos.WithStepName("fetch"), dbos.WithStepMaxRetries(3))
+}
+
+// MultiStepWorkflow runs sequential durable steps, each sleeping and logging. Completed steps are
+// checkpointed, so a workflow recovered after a crash resumes from the first step that did not complete.
+func MultiStepWorkflow(ctx dbos.DBOSContext, input MultiStepWorkflowInput) (string, error) {
+	workflowID, err := dbos.GetWorkflowID(ctx)
+	if err != nil {
+		return "", err
+	}
+	for step := 1; step <= multiStepCount; step++ {
+		attempts := 0
+		_, err := dbos.RunAsStep(ctx, func(stepCtx context.Context) (string, error) {
+			attempts++
+			slog.Info("Running step", "workflow_id", workflowID, "step", step, "attempt", attempts)
+			select {
+			case <-time.After(time.Duration(input.StepSeconds) * time.Second):
+			case <-stepCtx.Done():
+				return "", stepCtx.Err()
+			}
+			if input.FailFirstAttempt && step == 2 && attempts == 1 {
+				return "", fmt.Errorf("step %d failed on its first attempt", step)
+			}
+			return fmt.Sprintf("step %d done", step), nil
+		}, dbos.WithStepName(fmt.Sprintf("step-%d", step)), dbos.WithStepMaxRetries(3))
+		if err != nil {
+			return "", err
+		}
+	}
+	return fmt.Sprintf("Completed %d steps", multiStepCount), nil
+}
+
+// reportPageSize is the number of workflows QueueDepthReportWorkflow lists at a time
+const reportPageSize = 1000
+
+// QueueDepthReportWorkflow is run on the SCHEDULER_CRON schedule when ENABLE_SCHEDULER is set, by the leader pod only.
+// It logs the depth of every queue and is the place to hook periodic maintenance tasks.
+func QueueDepthReportWorkflow(ctx dbos.DBOSContext, scheduledTime time.Time) (string, error) {
+	queueDepths := make(map[string]int)
+	for offset := 0; ; offset += reportPageSize {
+		// ListWorkflows is recorded as a step when called from a workflow, one per page
+		workflows, err := dbos.ListWorkflows(ctx,
+			dbos.WithQueuesOnly(),
+			dbos.WithOffset(offset),
+			dbos.WithLimit(reportPageSize),
+			dbos.WithLoadInput(false),
+			dbos.WithLoadOutput(false),
+		)
+		if err != nil {
+			return "", err
+		}
+		for _, workflow := range workflows {
+			queueDepths[workflow.QueueName]++
+		}
+		if len(workflows) < reportPageSize {
+			break
+		}
+	}
+	for queueName, depth := range queueDepths {
+		slog.Info("Queue depth", "scheduled_time", scheduledTime, "queue", queueName, "depth", depth)
+	}
+	return fmt.Sprintf("Reported the depth of %d non-empty queues", len(queueDepths)), nil
+}
+
+func fibonacci(n int) int {
+	if n < 2 {
+		return n
+	}
+	return fibonacci(n-1) + fibonacci(n-2)
+}